@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A Blob is a stored file, shared by every message that sends the same content.
+// It is named after the SHA-256 of its content and removed once no message references it.
+type Blob struct {
+	Hash      string    `json:"hash" bson:"hash"`
+	File      string    `json:"filename" bson:"filename"`
+	Size      int64     `json:"size" bson:"size"`
+	Refs      int       `json:"refs" bson:"refs"`
+	CreatedAt time.Time `json:"createdat" bson:"createdat"`
+	UpdatedAt time.Time `json:"updatedat" bson:"updatedat"` // When a reference was last taken.
+}
+
+// Blob files are named after their hash, keeping the extension of the first upload.
+var blobFilePattern = regexp.MustCompile(`^[0-9a-f]{64}(\.[^.]*)?$`)
+
+func isBlobFile(name string) bool {
+	return blobFilePattern.MatchString(name)
+}
+
+// Taking a reference and dropping the last one each touch both the blob's document and its
+// file, so they are serialized per hash; hashes are spread over a fixed set of locks.
+var blobLocks [64]sync.Mutex
+
+func blobLock(hash string) *sync.Mutex {
+	var n uint32
+	for _, c := range hash {
+		n = n*31 + uint32(c)
+	}
+	return &blobLocks[n%uint32(len(blobLocks))]
+}
+
+// Store the content of src, hashing it while it streams to disk, and take a reference to the
+// resulting blob. Content that is already stored is not written again.
+func storeBlob(src io.Reader, filename string) (Blob, error) {
+	if err := ensureDir(uploadDir); err != nil {
+		return Blob{}, err
+	}
+
+	tmp, err := os.CreateTemp(uploadDir, ".blob-*")
+	if err != nil {
+		return Blob{}, err
+	}
+	defer os.Remove(tmp.Name()) // No-op once the temp file has been renamed.
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), src)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return Blob{}, err
+	}
+
+	hash := hex.EncodeToString(h.Sum(nil))
+	blob := Blob{
+		Hash:      hash,
+		File:      hash + strings.ToLower(filepath.Ext(filename)),
+		Size:      size,
+		CreatedAt: time.Now(),
+	}
+
+	lock := blobLock(hash)
+	lock.Lock()
+	defer lock.Unlock()
+
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err = blobsCollection.FindOneAndUpdate(ctx, bson.M{"hash": hash}, bson.M{
+		"$inc":         bson.M{"refs": 1},
+		"$set":         bson.M{"updatedat": blob.CreatedAt},
+		"$setOnInsert": bson.M{"filename": blob.File, "size": blob.Size, "createdat": blob.CreatedAt},
+	}, opts).Decode(&blob)
+	if err != nil {
+		return Blob{}, err
+	}
+
+	// The content is the same either way, so always put the new copy in place rather than
+	// trust a file that may be on its way out.
+	if err := os.Rename(tmp.Name(), filepath.Join(uploadDir, blob.File)); err != nil {
+		releaseBlobLocked(hash)
+		return Blob{}, err
+	}
+	return blob, nil
+}
+
+// Take another reference to an already stored blob.
+func retainBlob(hash string) error {
+	lock := blobLock(hash)
+	lock.Lock()
+	defer lock.Unlock()
+
+	res, err := blobsCollection.UpdateOne(ctx, bson.M{"hash": hash, "refs": bson.M{"$gt": 0}}, bson.M{
+		"$inc": bson.M{"refs": 1},
+		"$set": bson.M{"updatedat": time.Now()},
+	})
+	if err == nil && res.MatchedCount == 0 {
+		err = mongo.ErrNoDocuments // Released meanwhile; its file is gone.
+	}
+	return err
+}
+
+// Drop a reference to a blob, removing its file and derived images once nothing references it.
+func releaseBlob(hash string) {
+	if hash == "" {
+		return
+	}
+	lock := blobLock(hash)
+	lock.Lock()
+	defer lock.Unlock()
+	releaseBlobLocked(hash)
+}
+
+func releaseBlobLocked(hash string) {
+	var blob Blob
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := blobsCollection.FindOneAndUpdate(ctx, bson.M{"hash": hash}, bson.M{"$inc": bson.M{"refs": -1}}, opts).Decode(&blob)
+	if err != nil {
+		log.Println("Failed to release blob:", hash, err)
+		return
+	}
+	if blob.Refs > 0 {
+		return
+	}
+
+	// Files go before the document: a blob whose document exists always gets its file back
+	// from the next storeBlob.
+	removeMediaFiles(blob.File)
+	if _, err := blobsCollection.DeleteOne(ctx, bson.M{"hash": hash, "refs": bson.M{"$lte": 0}}); err != nil {
+		log.Println("Failed to delete blob:", hash, err)
+	}
+}
+
+// Remove a stored file together with its thumbnail and renditions.
+func removeMediaFiles(file string) {
+	paths := []string{filepath.Join(uploadDir, file), filepath.Join(uploadDir, "thumb", file)}
+	for _, r := range imageRenditions {
+		paths = append(paths, filepath.Join(uploadDir, r.Name, file))
+	}
+	for _, p := range paths {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			log.Println("Failed to remove media file:", p, err)
+		}
+	}
+}
+
+// Release the stored files of every live message in a chat.
+func releaseChatMedia(chatID string) error {
+	filter := bson.M{"chat_id": chatID, "deleted": false, "filename": bson.M{"$exists": true, "$ne": ""}}
+	cur, err := messagesCollection.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var msg Message
+		if err := cur.Decode(&msg); err != nil {
+			log.Println("Decode message error:", err)
+			continue
+		}
+		releaseMessageMedia(msg)
+	}
+	return cur.Err()
+}
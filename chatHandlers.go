@@ -49,6 +49,11 @@ func createChatHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Para
 		http.Error(w, "Contact not found", http.StatusNotFound)
 		return
 	}
+	// Contacts imported from vCards aren't users one can chat with.
+	if selectedContact.UserID == "" {
+		http.Error(w, "Contact is not a registered user", http.StatusBadRequest)
+		return
+	}
 
 	// Check if a chat already exists for this contact.
 	var existingChat Chat
@@ -70,6 +75,7 @@ func createChatHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Para
 		ContactID: req.ContactID,
 		Name:      selectedContact.Name,
 		Preview:   "", // Optionally, set a default preview.
+		Members:   []string{claims.UserID, selectedContact.UserID},
 	}
 
 	// Insert the new chat into MongoDB.
@@ -111,6 +117,7 @@ func chatsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 			log.Println("Decode chat error:", err)
 			continue
 		}
+		chat.Pins = activePins(chat.Pins)
 		chats = append(chats, chat)
 	}
 
@@ -118,6 +125,7 @@ func chatsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	if len(chats) == 0 {
 		chats = []Chat{}
 	}
+	setChatMentions(chats, claims.UserID)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(chats)
@@ -215,6 +223,14 @@ func deleteChatHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Par
 
 func hardDeleteChat(chatID string) error {
 	filter := bson.M{"chat_id": chatID}
+	if err := releaseChatMedia(chatID); err != nil {
+		return err
+	}
+	if _, err := messagesCollection.DeleteMany(ctx, filter); err != nil {
+		return err
+	}
+	redisClient.Del(ctx, "chat:"+chatID+":messages", mentionUnreadKey(chatID))
+	removeStars(filter)
 	_, err := chatsCollection.DeleteOne(ctx, filter)
 	return err
 }
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"nwr/utils"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Contact cards and vCard import/export of the address book.
+
+const MessageTypeContact = "contact"
+
+const (
+	maxVCardSize        = 64 << 10 // A single card sent in a message.
+	maxVCardImportSize  = 5 << 20
+	maxImportedContacts = 5000 // Per import.
+	// Longest name and organization, and longest phone number or e-mail address, in characters.
+	maxContactName   = 200
+	maxContactDetail = 200
+)
+
+// A contact shared in a message: either a registered user or the content of a vCard.
+type ContactCard struct {
+	UserID       string   `json:"user_id,omitempty" bson:"user_id,omitempty"`
+	Name         string   `json:"name" bson:"name"`
+	Phones       []string `json:"phones,omitempty" bson:"phones,omitempty"`
+	Emails       []string `json:"emails,omitempty" bson:"emails,omitempty"`
+	Organization string   `json:"organization,omitempty" bson:"organization,omitempty"`
+	VCard        string   `json:"vcard,omitempty" bson:"vcard,omitempty"` // As sent, when the card came from a vCard.
+}
+
+// Sanitize the text of a vCard like message text. A card must still have a name after.
+func sanitizeCard(card *utils.VCard) error {
+	name, err := sanitizeText(strings.TrimSpace(card.Name), maxContactName)
+	if err != nil {
+		return errors.New("name: " + err.Error())
+	}
+	if name == "" {
+		return errors.New("name is required")
+	}
+	org, err := sanitizeText(strings.TrimSpace(card.Organization), maxContactName)
+	if err != nil {
+		return errors.New("organization: " + err.Error())
+	}
+	for _, details := range [][]string{card.Phones, card.Emails} {
+		for i, d := range details {
+			if details[i], err = sanitizeText(strings.TrimSpace(d), maxContactDetail); err != nil {
+				return errors.New("phones and emails: " + err.Error())
+			}
+		}
+	}
+	card.Name, card.Organization = name, org
+	return nil
+}
+
+func importedContacts(userID string) ([]Contact, error) {
+	cur, err := contactsCollection.Find(ctx, bson.M{"owner_id": userID})
+	if err != nil {
+		return nil, err
+	}
+	var contacts []Contact
+	err = cur.All(ctx, &contacts)
+	return contacts, err
+}
+
+// Key identifying a contact's details, used to skip duplicates on import.
+func contactKey(name string, phones, emails []string) string {
+	return strings.ToLower(strings.TrimSpace(name)) + "|" + strings.Join(phones, ",") + "|" + strings.ToLower(strings.Join(emails, ","))
+}
+
+func contactVCard(c Contact) utils.VCard {
+	return utils.VCard{Name: c.Name, Phones: c.Phones, Emails: c.Emails, Organization: c.Organization}
+}
+
+// Read the vCard data of a request: the "file" form field, or the body itself.
+// At most limit+1 bytes are returned, so callers can tell when the data is too large.
+func readVCardUpload(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, limit+1<<20) // Room for the multipart envelope.
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return io.ReadAll(io.LimitReader(file, limit+1))
+	}
+	return io.ReadAll(io.LimitReader(r.Body, limit+1))
+}
+
+// --- Handlers ---
+
+// Import the contacts of a .vcf file (vCard 3.0 or 4.0) into the user's address book,
+// skipping ones already there and rejecting ones without a name or with invalid text.
+func importContactsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid Method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := readVCardUpload(w, r, maxVCardImportSize)
+	if err != nil {
+		http.Error(w, "Failed to read file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxVCardImportSize {
+		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	cards, err := utils.ParseVCards(bytes.NewReader(data))
+	if err != nil {
+		http.Error(w, "Invalid vCard file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(cards) > maxImportedContacts {
+		http.Error(w, "Too many contacts; the limit is "+strconv.Itoa(maxImportedContacts)+" per import", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	existing := make(map[string]bool)
+	for _, c := range getUserContacts(claims.UserID) {
+		existing[contactKey(c.Name, c.Phones, c.Emails)] = true
+	}
+
+	imported := []Contact{}
+	var docs []interface{}
+	skipped, rejected := 0, 0
+	for _, card := range cards {
+		if err := sanitizeCard(&card); err != nil {
+			rejected++
+			continue
+		}
+		key := contactKey(card.Name, card.Phones, card.Emails)
+		if existing[key] {
+			skipped++
+			continue
+		}
+		existing[key] = true
+
+		c := Contact{
+			ID:           utils.GenerateIntID(16),
+			Name:         card.Name,
+			OwnerID:      claims.UserID,
+			Phones:       card.Phones,
+			Emails:       card.Emails,
+			Organization: card.Organization,
+		}
+		imported = append(imported, c)
+		docs = append(docs, c)
+	}
+
+	if len(docs) > 0 {
+		if _, err := contactsCollection.InsertMany(ctx, docs); err != nil {
+			http.Error(w, "Failed to save contacts", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Imported []Contact `json:"imported"`
+		Skipped  int       `json:"skipped"`
+		Rejected int       `json:"rejected"` // Cards without a usable name, or with invalid text.
+	}{
+		Imported: imported,
+		Skipped:  skipped,
+		Rejected: rejected,
+	})
+}
+
+// Export the user's address book as a .vcf file. Pass ?version=4.0 for vCard 4.0;
+// the default is 3.0, which more address books understand.
+func exportContactsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	version := r.URL.Query().Get("version")
+	if version == "" {
+		version = "3.0"
+	}
+	if version != "3.0" && version != "4.0" {
+		http.Error(w, "version must be 3.0 or 4.0", http.StatusBadRequest)
+		return
+	}
+
+	var buf bytes.Buffer
+	for _, c := range getUserContacts(claims.UserID) {
+		if err := utils.WriteVCard(&buf, contactVCard(c), version); err != nil {
+			http.Error(w, "Failed to export contacts", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/vcard; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="contacts.vcf"`)
+	w.Write(buf.Bytes())
+}
+
+// Share a contact card in a chat: either contact_id, one of the user's contacts, or vcard,
+// the text of a single vCard.
+func sendContactHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		ContactID string `json:"contact_id"`
+		VCard     string `json:"vcard"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxVCardSize+1<<10)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request data", http.StatusBadRequest)
+		return
+	}
+	if (req.ContactID == "") == (req.VCard == "") {
+		http.Error(w, "Either contact_id or vcard is required", http.StatusBadRequest)
+		return
+	}
+
+	var card ContactCard
+	if req.ContactID != "" {
+		var contact *Contact
+		for _, c := range getUserContacts(claims.UserID) {
+			if c.ID == req.ContactID {
+				contact = &c
+				break
+			}
+		}
+		if contact == nil {
+			http.Error(w, "Contact not found", http.StatusNotFound)
+			return
+		}
+		card = ContactCard{
+			UserID:       contact.UserID,
+			Name:         contact.Name,
+			Phones:       contact.Phones,
+			Emails:       contact.Emails,
+			Organization: contact.Organization,
+		}
+	} else {
+		if len(req.VCard) > maxVCardSize {
+			http.Error(w, "vCard too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		cards, err := utils.ParseVCards(strings.NewReader(req.VCard))
+		if err != nil {
+			http.Error(w, "Invalid vCard: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(cards) != 1 {
+			http.Error(w, "vcard must contain exactly one card", http.StatusBadRequest)
+			return
+		}
+		if err := sanitizeCard(&cards[0]); err != nil {
+			http.Error(w, "Invalid vCard: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		card = ContactCard{
+			Name:         cards[0].Name,
+			Phones:       cards[0].Phones,
+			Emails:       cards[0].Emails,
+			Organization: cards[0].Organization,
+			VCard:        req.VCard,
+		}
+	}
+
+	chat, err := getMemberChat(ps.ByName("chatid"), claims.UserID)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch chat", http.StatusInternalServerError)
+		return
+	}
+
+	msg := Message{
+		MessageID: generateMessageID(),
+		ChatID:    chat.ChatID,
+		Type:      MessageTypeContact,
+		Sender:    claims.UserID,
+		Content:   card.Name,
+		Contact:   &card,
+		CreatedAt: time.Now(),
+	}
+	if err := deliverMessage(&msg); err != nil {
+		http.Error(w, "Failed to save contact", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msg)
+}
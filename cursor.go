@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Keyset cursors page through lists ordered by a time and then an ID. Unlike a bare time,
+// they neither skip nor repeat items sharing the time of a page's last item.
+
+// Cursor of the page after the item at (t, id).
+func encodeCursor(t time.Time, id string) string {
+	return strconv.FormatInt(t.UnixNano(), 10) + "_" + id
+}
+
+func decodeCursor(cursor string) (time.Time, string, bool) {
+	nanosStr, id, ok := strings.Cut(cursor, "_")
+	nanos, err := strconv.ParseInt(nanosStr, 10, 64)
+	if !ok || err != nil || id == "" {
+		return time.Time{}, "", false
+	}
+	return time.Unix(0, nanos), id, true
+}
+
+// Filter for the items after (t, id) when sorted by timeField and then idField, descending,
+// or ascending when ascending is set.
+func cursorFilter(timeField, idField string, t time.Time, id string, ascending bool) bson.M {
+	op := "$lt"
+	if ascending {
+		op = "$gt"
+	}
+	return bson.M{"$or": []bson.M{
+		{timeField: bson.M{op: t}},
+		{timeField: t, idField: bson.M{op: id}},
+	}}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"nwr/utils"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Disappearing messages: a chat's timer gives every new message an expiry, and the reaper
+// removes expired messages from MongoDB, the Redis buffer and media storage.
+
+const reaperInterval = time.Minute
+
+// Timers members can choose from.
+var disappearingTimers = map[string]time.Duration{
+	"off": 0,
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+	"90d": 90 * 24 * time.Hour,
+}
+
+// Give a new message the expiry of its chat's disappearing-messages timer, if any.
+func setMessageExpiry(msg *Message) {
+	var chat Chat
+	if err := chatsCollection.FindOne(ctx, bson.M{"chat_id": msg.ChatID}).Decode(&chat); err != nil {
+		return
+	}
+	if timer, ok := disappearingTimers[chat.DisappearingTimer]; ok && timer > 0 {
+		expiresAt := msg.CreatedAt.Add(timer)
+		msg.ExpiresAt = &expiresAt
+	}
+}
+
+// Remove a message for good, along with everything that refers to it.
+func purgeMessage(msg Message) {
+	if _, err := messagesCollection.DeleteOne(ctx, bson.M{"message_id": msg.MessageID}); err != nil {
+		log.Println("Failed to purge message:", msg.MessageID, err)
+		return
+	}
+	if !msg.Deleted {
+		releaseMessageMedia(msg)
+		markQuotesDeleted(msg.ChatID, msg.MessageID)
+		recordThreadReplyDeleted(msg)
+		removePin(msg.ChatID, msg.MessageID)
+		removeStars(bson.M{"message_id": msg.MessageID})
+	}
+
+	wsMessage := struct {
+		Type      string `json:"type"`
+		ChatID    string `json:"chat_id"`
+		MessageID string `json:"message_id"`
+	}{
+		Type:      "expire",
+		ChatID:    msg.ChatID,
+		MessageID: msg.MessageID,
+	}
+	wsBroadcast(msg.ChatID, wsMessage)
+}
+
+// Periodically remove expired messages.
+func runReaper() {
+	ticker := time.NewTicker(reaperInterval)
+	for range ticker.C {
+		now := time.Now()
+
+		cur, err := messagesCollection.Find(ctx, bson.M{"expiresat": bson.M{"$lte": now}})
+		if err != nil {
+			log.Println("Reaper query error:", err)
+			continue
+		}
+		var expired []Message
+		if err := cur.All(ctx, &expired); err != nil {
+			log.Println("Reaper decode error:", err)
+		}
+		for _, msg := range expired {
+			purgeMessage(msg)
+		}
+
+		reapBufferedMessages(now)
+	}
+}
+
+// Drop expired messages still waiting in the Redis buffer.
+func reapBufferedMessages(now time.Time) {
+	keys, err := redisClient.Keys(ctx, "chat:*:messages").Result()
+	if err != nil {
+		log.Println("Redis scan error:", err)
+		return
+	}
+	for _, key := range keys {
+		entries, err := redisClient.LRange(ctx, key, 0, -1).Result()
+		if err != nil {
+			log.Println("Redis LRange error:", err)
+			continue
+		}
+		for _, mStr := range entries {
+			var msg Message
+			if err := json.Unmarshal([]byte(mStr), &msg); err != nil || msg.ExpiresAt == nil || msg.ExpiresAt.After(now) {
+				continue
+			}
+			if err := redisClient.LRem(ctx, key, 1, mStr).Err(); err != nil {
+				log.Println("Redis LRem error:", err)
+				continue
+			}
+			releaseMessageMedia(msg)
+		}
+	}
+}
+
+// --- Handlers ---
+
+// Set a chat's disappearing-messages timer: "off", "24h", "7d" or "90d".
+// Only messages sent afterwards are affected.
+func disappearingHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPut {
+		http.Error(w, "Invalid Method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Timer string `json:"timer"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request data", http.StatusBadRequest)
+		return
+	}
+	req.Timer = strings.ToLower(strings.TrimSpace(req.Timer))
+	if _, ok := disappearingTimers[req.Timer]; !ok {
+		http.Error(w, "timer must be off, 24h, 7d or 90d", http.StatusBadRequest)
+		return
+	}
+
+	chat, err := getMemberChat(ps.ByName("chatid"), claims.UserID)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch chat", http.StatusInternalServerError)
+		return
+	}
+
+	current := chat.DisappearingTimer
+	if current == "" {
+		current = "off"
+	}
+	if current != req.Timer {
+		var update bson.M
+		if req.Timer == "off" {
+			update = bson.M{"$unset": bson.M{"disappearing_timer": ""}}
+		} else {
+			update = bson.M{"$set": bson.M{"disappearing_timer": req.Timer}}
+		}
+		if _, err := chatsCollection.UpdateOne(ctx, bson.M{"chat_id": chat.ChatID}, update); err != nil {
+			http.Error(w, "Failed to update chat", http.StatusInternalServerError)
+			return
+		}
+		saveSystemMessage(chat.ChatID, SystemEvent{Action: "disappearing_timer", Actor: claims.UserID, Value: req.Timer})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bson.M{"chat_id": chat.ChatID, "timer": req.Timer})
+}
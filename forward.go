@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"nwr/utils"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Messages forwarded this many times or more are "frequently forwarded" and can only be
+// forwarded to one chat at a time, to slow down chains.
+var frequentlyForwardedThreshold = int(utils.EnvInt64("FREQUENTLY_FORWARDED_THRESHOLD", 5))
+
+const maxForwardTargets = 5
+
+// Copy a message into another chat, sharing its stored file. A forwarded poll starts over
+// without votes or a close time, and a live location is forwarded as its latest position.
+func forwardedCopy(src Message, chatID, sender string) Message {
+	var poll *Poll
+	if src.Poll != nil {
+		poll = &Poll{
+			Question:       src.Poll.Question,
+			Options:        src.Poll.Options,
+			MultipleChoice: src.Poll.MultipleChoice,
+			Anonymous:      src.Poll.Anonymous,
+		}
+	}
+	var loc *Location
+	if src.Location != nil {
+		loc = &Location{
+			Latitude:  src.Location.Latitude,
+			Longitude: src.Location.Longitude,
+			Accuracy:  src.Location.Accuracy,
+			Name:      src.Location.Name,
+		}
+	}
+	var voice *VoiceNote
+	if src.Voice != nil {
+		voice = &VoiceNote{Duration: src.Voice.Duration, Waveform: src.Voice.Waveform}
+	}
+	// Mentions are of members of the source chat, so they don't carry over.
+	text, entities := formatText(src.Content, nil)
+	return Message{
+		MessageID:     generateMessageID(),
+		ChatID:        chatID,
+		Type:          src.Type,
+		Sender:        sender,
+		Content:       src.Content,
+		Text:          text,
+		Entities:      entities,
+		LinkPreview:   src.LinkPreview,
+		Caption:       src.Caption,
+		File:          src.File,
+		BlobHash:      src.BlobHash,
+		OriginalName:  src.OriginalName,
+		Size:          src.Size,
+		AsDocument:    src.AsDocument,
+		ForwardCount:  src.ForwardCount + 1,
+		Poll:          poll,
+		Location:      loc,
+		Contact:       src.Contact,
+		Voice:         voice,
+		Width:         src.Width,
+		Height:        src.Height,
+		Thumbnail:     src.Thumbnail,
+		Renditions:    src.Renditions,
+		BlurHash:      src.BlurHash,
+		DominantColor: src.DominantColor,
+		CreatedAt:     time.Now(),
+	}
+}
+
+// Forward a message to one or more chats without re-uploading its file.
+func forwardMessageHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid Method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		MessageID string   `json:"message_id"`
+		ChatIDs   []string `json:"chat_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request data", http.StatusBadRequest)
+		return
+	}
+
+	var targets []string
+	for _, chatID := range req.ChatIDs {
+		if chatID != "" && !utils.Contains(targets, chatID) {
+			targets = append(targets, chatID)
+		}
+	}
+	if req.MessageID == "" || len(targets) == 0 {
+		http.Error(w, "message_id and chat_ids are required", http.StatusBadRequest)
+		return
+	}
+	if len(targets) > maxForwardTargets {
+		http.Error(w, "Too many target chats", http.StatusBadRequest)
+		return
+	}
+
+	src, err := getMemberMessage(req.MessageID, claims.UserID)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch message", http.StatusInternalServerError)
+		return
+	}
+	if src.ViewOnce {
+		http.Error(w, "View-once messages can't be forwarded", http.StatusForbidden)
+		return
+	}
+	if src.ForwardCount >= frequentlyForwardedThreshold && len(targets) > 1 {
+		http.Error(w, "Frequently forwarded messages can only be forwarded to one chat at a time", http.StatusTooManyRequests)
+		return
+	}
+
+	for _, chatID := range targets {
+		if _, err := getMemberChat(chatID, claims.UserID); err == mongo.ErrNoDocuments {
+			http.Error(w, "Chat not found: "+chatID, http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to fetch chat", http.StatusInternalServerError)
+			return
+		}
+		if src.Size > 0 {
+			release, err := reserveStorageQuota(claims.UserID, chatID, src.Size)
+			if err == errStorageQuota {
+				http.Error(w, "Storage quota exceeded", http.StatusRequestEntityTooLarge)
+				return
+			} else if err != nil {
+				http.Error(w, "Failed to check storage quota", http.StatusInternalServerError)
+				return
+			}
+			defer release()
+		}
+	}
+
+	forwarded := []Message{}
+	for _, chatID := range targets {
+		msg := forwardedCopy(src, chatID, claims.UserID)
+		if msg.BlobHash != "" {
+			if err := retainBlob(msg.BlobHash); err != nil {
+				log.Println("Failed to retain blob:", msg.BlobHash, err)
+				continue
+			}
+		}
+		if err := deliverMessage(&msg); err != nil {
+			log.Println("Failed to save forwarded message:", err)
+			releaseBlob(msg.BlobHash)
+			continue
+		}
+		forwarded = append(forwarded, msg)
+	}
+
+	if len(forwarded) == 0 {
+		http.Error(w, "Failed to forward message", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(forwarded)
+}
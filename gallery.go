@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"nwr/utils"
+	"regexp"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Message types for messages carrying a file.
+const (
+	MessageTypeImage    = "image"
+	MessageTypeDocument = "document"
+)
+
+const (
+	defaultGalleryLimit = 30
+	maxGalleryLimit     = 100
+)
+
+var urlPattern = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// Matches images sent before messages recorded their type.
+const legacyImagePattern = `(?i)\.(jpe?g|png|gif|webp|bmp|tiff?)$`
+
+// An entry of a chat's shared media gallery.
+type MediaItem struct {
+	Message
+	Links []string `json:"links,omitempty"`
+}
+
+func galleryFilter(chatID, mediaType string) (bson.M, bool) {
+	// View-once media is only ever shown through its message.
+	filter := bson.M{"chat_id": chatID, "deleted": false, "view_once": bson.M{"$ne": true}}
+	switch mediaType {
+	case "image":
+		filter["$or"] = []bson.M{
+			{"type": MessageTypeImage},
+			{"type": bson.M{"$exists": false}, "filename": bson.M{"$regex": legacyImagePattern}},
+		}
+	case "document":
+		filter["$or"] = []bson.M{
+			{"type": MessageTypeDocument},
+			{"type": bson.M{"$exists": false}, "filename": bson.M{"$exists": true, "$ne": "", "$not": bson.M{"$regex": legacyImagePattern}}},
+		}
+	case "link":
+		filter["content"] = bson.M{"$regex": `https?://`}
+	default:
+		return nil, false
+	}
+	return filter, true
+}
+
+// List a chat's images, documents or links, newest first.
+// Pages are requested with ?before=<next_cursor of the previous page>.
+func chatMediaHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	chat, err := getMemberChat(ps.ByName("chatid"), claims.UserID)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch chat", http.StatusInternalServerError)
+		return
+	}
+
+	chatID := chat.ChatID
+	query := r.URL.Query()
+
+	filter, ok := galleryFilter(chatID, query.Get("type"))
+	if !ok {
+		http.Error(w, "type must be image, document or link", http.StatusBadRequest)
+		return
+	}
+
+	limit := int64(defaultGalleryLimit)
+	if l, err := strconv.ParseInt(query.Get("limit"), 10, 64); err == nil && l > 0 {
+		limit = min(l, maxGalleryLimit)
+	}
+
+	if before := query.Get("before"); before != "" {
+		createdAt, messageID, ok := decodeCursor(before)
+		if !ok {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		// The type filter has its own $or.
+		filter = bson.M{"$and": []bson.M{filter, cursorFilter("createdat", "message_id", createdAt, messageID, false)}}
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "createdat", Value: -1}, {Key: "message_id", Value: -1}}).SetLimit(limit)
+	cur, err := messagesCollection.Find(ctx, filter, opts)
+	if err != nil {
+		http.Error(w, "Failed to fetch media", http.StatusInternalServerError)
+		return
+	}
+	var msgs []Message
+	if err := cur.All(ctx, &msgs); err != nil {
+		http.Error(w, "Failed to fetch media", http.StatusInternalServerError)
+		return
+	}
+
+	items := []MediaItem{}
+	for _, m := range msgs {
+		item := MediaItem{Message: m}
+		if query.Get("type") == "link" {
+			item.Links = urlPattern.FindAllString(m.Content, -1)
+		}
+		items = append(items, item)
+	}
+
+	var nextCursor string
+	if int64(len(msgs)) == limit {
+		last := msgs[len(msgs)-1]
+		nextCursor = encodeCursor(last.CreatedAt, last.MessageID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Items      []MediaItem `json:"items"`
+		NextCursor string      `json:"next_cursor,omitempty"`
+	}{
+		Items:      items,
+		NextCursor: nextCursor,
+	})
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"log"
+	"net/http"
+	"nwr/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Storage garbage collection: files in the upload directories that no message, blob or
+// pending upload refers to are removed, along with blobs no live message points at.
+
+const (
+	gcInterval = 6 * time.Hour
+	// Files younger than this are left alone so in-flight sends are never collected.
+	gcGracePeriod = 24 * time.Hour
+)
+
+type GCReport struct {
+	DryRun         bool      `json:"dry_run"`
+	StartedAt      time.Time `json:"startedat"`
+	Duration       string    `json:"duration"`
+	ScannedFiles   int       `json:"scanned_files"`
+	RemovedFiles   []string  `json:"removed_files"`
+	RemovedBlobs   []string  `json:"removed_blobs"`
+	ReclaimedBytes int64     `json:"reclaimed_bytes"`
+}
+
+var (
+	gcMu         sync.Mutex
+	lastGCReport *GCReport
+)
+
+// Run the collector periodically. Set UPLOAD_GC_DRY_RUN=true to only report what would be removed.
+func runUploadGC() {
+	dryRun := utils.EnvBool("UPLOAD_GC_DRY_RUN", false)
+	ticker := time.NewTicker(gcInterval)
+	for range ticker.C {
+		report, err := collectGarbage(dryRun)
+		if err != nil {
+			log.Println("Upload GC error:", err)
+			continue
+		}
+		log.Printf("Upload GC (dry run: %v): removed %d files and %d blobs, reclaimed %d bytes",
+			report.DryRun, len(report.RemovedFiles), len(report.RemovedBlobs), report.ReclaimedBytes)
+	}
+}
+
+// Files referenced by messages that have not been deleted, including scheduled ones and
+// those still buffered in Redis.
+func liveMessageFiles() (map[string]bool, error) {
+	files := make(map[string]bool)
+
+	opts := options.Find().SetProjection(bson.M{"filename": 1})
+	cur, err := messagesCollection.Find(ctx, bson.M{"deleted": false, "filename": bson.M{"$exists": true, "$ne": ""}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var msg Message
+		if err := cur.Decode(&msg); err != nil {
+			log.Println("Decode message error:", err)
+			continue
+		}
+		files[msg.File] = true
+	}
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := scheduledMessageFiles(files); err != nil {
+		return nil, err
+	}
+
+	keys, err := redisClient.Keys(ctx, "chat:*:messages").Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		msgs, err := redisClient.LRange(ctx, key, 0, -1).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, mStr := range msgs {
+			var msg Message
+			if err := json.Unmarshal([]byte(mStr), &msg); err == nil && msg.File != "" && !msg.Deleted {
+				files[msg.File] = true
+			}
+		}
+	}
+	return files, nil
+}
+
+// Whether a blob can go, given the files live messages referred to before the blobs were read.
+// A send takes its reference before its message is saved, so a blob referenced recently may
+// belong to a message the references missed; like new files, it is left for a later run.
+func blobCollectable(blob Blob, referenced map[string]bool, cutoff time.Time) bool {
+	return !referenced[blob.File] && !blob.CreatedAt.After(cutoff) && !blob.UpdatedAt.After(cutoff)
+}
+
+// Reconcile the storage directories against message references.
+func collectGarbage(dryRun bool) (*GCReport, error) {
+	gcMu.Lock()
+	defer gcMu.Unlock()
+
+	report := &GCReport{DryRun: dryRun, StartedAt: time.Now(), RemovedFiles: []string{}, RemovedBlobs: []string{}}
+	cutoff := report.StartedAt.Add(-gcGracePeriod)
+
+	referenced, err := liveMessageFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	// Blobs that no live message points at any more.
+	var blobs []Blob
+	cur, err := blobsCollection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	if err := cur.All(ctx, &blobs); err != nil {
+		return nil, err
+	}
+	for _, blob := range blobs {
+		if !blobCollectable(blob, referenced, cutoff) {
+			referenced[blob.File] = true
+			continue
+		}
+		if !dryRun {
+			// Matching on refs leaves the blob alone if a send picked it up meanwhile.
+			res, err := blobsCollection.DeleteOne(ctx, bson.M{"hash": blob.Hash, "refs": blob.Refs})
+			if err != nil || res.DeletedCount == 0 {
+				referenced[blob.File] = true
+				continue
+			}
+		}
+		report.RemovedBlobs = append(report.RemovedBlobs, blob.Hash)
+	}
+
+	// Derived images live in subdirectories and share their original's name.
+	derivedDirs := map[string]bool{"thumb": true}
+	for _, r := range imageRenditions {
+		derivedDirs[r.Name] = true
+	}
+	err = sweepDir(uploadDir, cutoff, dryRun, report, func(rel string) bool {
+		dir, name := filepath.Split(rel)
+		dir = strings.TrimSuffix(dir, string(filepath.Separator))
+		if (dir != "" && !derivedDirs[dir]) || !isBlobFile(name) {
+			return true // Not ours to manage.
+		}
+		return referenced[name]
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Link preview images no live message shows. A cached preview can still hand its image
+	// out to new messages, so images are kept for as long as the cache too.
+	previews, err := livePreviewImages()
+	if err != nil {
+		return nil, err
+	}
+	previewCutoff := cutoff
+	if c := report.StartedAt.Add(-linkPreviewTTL); c.Before(previewCutoff) {
+		previewCutoff = c
+	}
+	err = sweepDir(filepath.Join(uploadDir, previewImageDir), previewCutoff, dryRun, report, func(rel string) bool {
+		return previews[rel]
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// View-once media of messages that have been opened or deleted.
+	err = sweepDir(viewOnceDir, cutoff, dryRun, report, func(rel string) bool {
+		return referenced[rel]
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Partial files of resumable uploads whose record has gone.
+	pending := make(map[string]bool)
+	var uploads []Upload
+	cur, err = uploadsCollection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	if err := cur.All(ctx, &uploads); err != nil {
+		return nil, err
+	}
+	for _, up := range uploads {
+		pending[up.UploadID] = true
+	}
+	err = sweepDir(partialUploadDir, cutoff, dryRun, report, func(rel string) bool {
+		return pending[rel]
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report.Duration = time.Since(report.StartedAt).String()
+	lastGCReport = report
+	return report, nil
+}
+
+// Remove files under root older than cutoff for which keep returns false.
+func sweepDir(root string, cutoff time.Time, dryRun bool, report *GCReport, keep func(rel string) bool) error {
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		report.ScannedFiles++
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil || keep(rel) || info.ModTime().After(cutoff) {
+			return nil
+		}
+
+		if !dryRun {
+			if err := os.Remove(path); err != nil {
+				log.Println("Upload GC remove error:", path, err)
+				return nil
+			}
+		}
+		report.RemovedFiles = append(report.RemovedFiles, path)
+		report.ReclaimedBytes += info.Size()
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Run the collector on demand (admins only). Pass ?dry_run=true to only get the report.
+func gcHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !utils.Contains(utils.EnvList("ADMIN_USER_IDS"), claims.UserID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	report, err := collectGarbage(r.URL.Query().Get("dry_run") == "true")
+	if err != nil {
+		http.Error(w, "Failed to collect garbage: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// Return the report of the most recent collection (admins only).
+func gcReportHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !utils.Contains(utils.EnvList("ADMIN_USER_IDS"), claims.UserID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	gcMu.Lock()
+	report := lastGCReport
+	gcMu.Unlock()
+	if report == nil {
+		http.Error(w, "No collection has run yet", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBlobCollectable(t *testing.T) {
+	start := time.Date(2024, 5, 2, 12, 0, 0, 0, time.UTC)
+	cutoff := start.Add(-gcGracePeriod)
+	old := cutoff.Add(-time.Hour)
+
+	// The collector reads the live references first; a forward then takes a reference to a
+	// blob its message is not yet saved with, and only after that are the blobs read.
+	referenced := map[string]bool{"kept.jpg": true}
+	forwarded := Blob{File: "forwarded.jpg", Refs: 2, CreatedAt: old, UpdatedAt: start.Add(time.Second)}
+
+	tests := []struct {
+		name string
+		blob Blob
+		want bool
+	}{
+		{"unreferenced", Blob{File: "gone.jpg", Refs: 1, CreatedAt: old, UpdatedAt: old}, true},
+		{"never retained", Blob{File: "gone.jpg", Refs: 1, CreatedAt: old}, true},
+		{"referenced", Blob{File: "kept.jpg", Refs: 1, CreatedAt: old, UpdatedAt: old}, false},
+		{"stored recently", Blob{File: "new.jpg", Refs: 1, CreatedAt: start, UpdatedAt: start}, false},
+		{"retained during the run", forwarded, false},
+		{"retained just before the run", Blob{File: "sent.jpg", Refs: 2, CreatedAt: old, UpdatedAt: start.Add(-time.Minute)}, false},
+	}
+	for _, tt := range tests {
+		if got := blobCollectable(tt.blob, referenced, cutoff); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
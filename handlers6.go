@@ -1,24 +1,28 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
-	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"nwr/utils"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // --- Utility Functions ---
 
 func getChatMessages(chatID string, limit int64) ([]Message, error) {
-	filter := bson.M{"chat_id": chatID, "deleted": false}
+	// Thread replies are fetched through their thread.
+	filter := bson.M{"chat_id": chatID, "deleted": false, "thread_id": bson.M{"$exists": false}}
 	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(limit)
 
 	cur, err := messagesCollection.Find(ctx, filter, opts)
@@ -49,12 +53,77 @@ func saveMessage(msg Message) error {
 	return err
 }
 
+// Push a new message to the chat's live connections.
+func broadcastMessage(msg Message) {
+	wsMessage := struct {
+		Type    string  `json:"type"`
+		ChatID  string  `json:"chat_id"`
+		Message Message `json:"message"`
+	}{
+		Type:    "message",
+		ChatID:  msg.ChatID,
+		Message: msg,
+	}
+	wsBroadcast(msg.ChatID, wsMessage)
+}
+
+// Save a new message and run what follows a send: the chat's expiry timer, thread
+// bookkeeping, the live broadcast, mentions and notifications, link previews and
+// processing of images not processed yet.
+func deliverMessage(msg *Message) error {
+	setMessageExpiry(msg)
+	if err := saveMessage(*msg); err != nil {
+		return err
+	}
+
+	if msg.ThreadID != "" {
+		if root, err := getThreadRoot(msg.ChatID, msg.ThreadID); err == nil {
+			recordThreadReply(root, *msg)
+		} else {
+			log.Println("Thread root lookup error:", msg.ThreadID, err)
+		}
+	} else {
+		broadcastMessage(*msg)
+	}
+
+	recordMentions(*msg, nil)
+	if msg.Type != MessageTypeSystem {
+		notifyMembers(*msg)
+	}
+
+	enqueueLinkPreview(*msg)
+
+	// View-once images get no thumbnails or placeholders, which would be served publicly.
+	if msg.Type == MessageTypeImage && msg.Thumbnail == "" && !msg.ViewOnce {
+		enqueueMediaJob(mediaJob{ChatID: msg.ChatID, MessageID: msg.MessageID, File: msg.File})
+	}
+	return nil
+}
+
 func updateMessage(chatID, messageID string, update bson.M) error {
 	filter := bson.M{"chat_id": chatID, "message_id": messageID}
 	_, err := messagesCollection.UpdateOne(ctx, filter, bson.M{"$set": update})
 	return err
 }
 
+// Mark a message as deleted and return it, or nil if it was already deleted.
+func softDeleteMessage(chatID, messageID string) (*Message, error) {
+	filter := bson.M{"chat_id": chatID, "message_id": messageID, "deleted": false}
+	var msg Message
+	err := messagesCollection.FindOneAndUpdate(ctx, filter, bson.M{"$set": bson.M{"deleted": true}}).Decode(&msg)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	markQuotesDeleted(chatID, messageID)
+	removePin(chatID, messageID)
+	removeStars(bson.M{"message_id": messageID})
+	recordThreadReplyDeleted(msg)
+	return &msg, nil
+}
+
 // --- Handlers ---
 
 // Fetch messages from MongoDB
@@ -65,7 +134,6 @@ func messagesHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	_ = claims
 
 	chatID := r.URL.Query().Get("chat_id")
 	if chatID == "" {
@@ -79,6 +147,16 @@ func messagesHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params
 		return
 	}
 
+	for i := range messages {
+		messages[i].ReactionSummary = summarizeReactions(messages[i].Reactions, claims.UserID)
+		if messages[i].Poll != nil {
+			messages[i].Poll.tally(claims.UserID)
+		}
+	}
+	setThreadUnread(messages, claims.UserID)
+	setViewOnceOpened(messages, claims.UserID)
+	redisClient.HDel(ctx, mentionUnreadKey(chatID), claims.UserID)
+
 	json.NewEncoder(w).Encode(messages)
 }
 
@@ -96,8 +174,9 @@ func sendMessageHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Par
 		return
 	}
 
+	// Requests attaching a resumable upload may be sent without a multipart body.
 	err = r.ParseMultipartForm(10 << 20) // 10MB limit
-	if err != nil {
+	if err != nil && err != http.ErrNotMultipart {
 		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -110,34 +189,252 @@ func sendMessageHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Par
 		http.Error(w, "chat_id is required", http.StatusBadRequest)
 		return
 	}
+	if content, err = sanitizeText(content, maxContentLength); err != nil {
+		http.Error(w, "content: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if caption, err = sanitizeText(caption, maxCaptionLength); err != nil {
+		http.Error(w, "caption: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var replyTo *Quote
+	if replyToID := r.FormValue("reply_to"); replyToID != "" {
+		original, err := getMessage(chatID, replyToID)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "reply_to message not found in this chat", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to fetch reply_to message", http.StatusInternalServerError)
+			return
+		}
+		replyTo = newQuote(original)
+	}
+
+	if threadID := r.FormValue("thread_id"); threadID != "" {
+		if _, err := getThreadRoot(chatID, threadID); err == mongo.ErrNoDocuments {
+			http.Error(w, "thread_id must be a top-level message in this chat", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to fetch thread", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var entities []Mention
+	if v := r.FormValue("mentions"); v != "" {
+		if err := json.Unmarshal([]byte(v), &entities); err != nil {
+			http.Error(w, "Invalid mentions", http.StatusBadRequest)
+			return
+		}
+	}
+	rememberHandle(claims.Username, claims.UserID)
+	mentions, err := chatMentions(chatID, content, entities)
+	if isMentionError(err) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err == mongo.ErrNoDocuments {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to check mentions", http.StatusInternalServerError)
+		return
+	}
+
+	// Messages with a send_at time are held back and delivered by the scheduler.
+	var sendAt time.Time
+	if v := r.FormValue("send_at"); v != "" {
+		if sendAt, err = parseSendAt(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
-	var filename string
-	if file, header, err := r.FormFile("file"); err == nil {
+	// "Send as document" keeps the file byte-for-byte and skips image processing.
+	asDocument := r.FormValue("as_document") == "true"
+
+	// View-once media bypasses the public, deduplicated store.
+	viewOnce := r.FormValue("view_once") == "true"
+
+	// Voice notes carry a duration and waveform; see newVoiceNote.
+	isVoice := r.FormValue("voice") == "true"
+	if isVoice && asDocument {
+		http.Error(w, "voice and as_document can't be combined", http.StatusBadRequest)
+		return
+	}
+
+	// The file comes either from the form or from a finished resumable upload.
+	var src io.Reader
+	var filename, contentType string
+	var size int64
+	var upload *Upload
+	if uploadID := r.FormValue("upload_id"); uploadID != "" {
+		up, err := getUpload(uploadID, claims.UserID)
+		if err != nil {
+			http.Error(w, "Upload not found", http.StatusNotFound)
+			return
+		}
+		if !up.complete() {
+			http.Error(w, "Upload is not complete", http.StatusConflict)
+			return
+		}
+		f, err := os.Open(up.path())
+		if err != nil {
+			http.Error(w, "Failed to open upload: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		src, filename, contentType, size, upload = f, up.Filename, up.ContentType, up.Length, &up
+		if filename == "" {
+			filename = up.UploadID
+		}
+	} else if file, header, err := r.FormFile("file"); err == nil {
 		defer file.Close()
-		filename = header.Filename
-		if err := saveUploadedFile(file, filename); err != nil {
+		src, filename, contentType, size = file, header.Filename, header.Header.Get("Content-Type"), header.Size
+	}
+	if viewOnce && src == nil {
+		http.Error(w, "view_once requires a file", http.StatusBadRequest)
+		return
+	}
+	if isVoice && src == nil {
+		http.Error(w, "voice requires a file", http.StatusBadRequest)
+		return
+	}
+
+	var isImage bool
+	var voice *VoiceNote
+	var blob Blob
+	if src != nil {
+		// A finished resumable upload already counts towards the quota while pending.
+		quotaSize := size
+		if upload != nil {
+			quotaSize = 0
+		}
+		release, err := reserveStorageQuota(claims.UserID, chatID, quotaSize)
+		if err == errStorageQuota {
+			http.Error(w, "Storage quota exceeded", http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to check storage quota", http.StatusInternalServerError)
+			return
+		}
+		defer release() // By then the message is saved and counted, or was never sent.
+
+		isImage = !asDocument && !isVoice && isImageUpload(contentType, filename)
+
+		if isImage {
+			// Strip EXIF/XMP (including GPS coordinates) before the file is stored.
+			data, err := io.ReadAll(io.LimitReader(src, maxImageUploadSize+1))
+			if err != nil {
+				http.Error(w, "Failed to read file: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if len(data) > maxImageUploadSize {
+				http.Error(w, "Image too large; send it as a document", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err := utils.CheckImagePixels(data, utils.MaxImagePixels); err == utils.ErrImageTooLarge {
+				http.Error(w, "Image dimensions too large; send it as a document", http.StatusRequestEntityTooLarge)
+				return
+			} else if err != nil {
+				http.Error(w, "Invalid image: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if data, err = utils.StripImageMetadata(data); err != nil {
+				http.Error(w, "Invalid image: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			// WebP images come back as JPEG or PNG; name the file after what it holds now.
+			if ext := utils.ImageExtension(data); ext != "" && !sameImageExtension(filepath.Ext(filename), ext) {
+				filename = strings.TrimSuffix(filename, filepath.Ext(filename)) + ext
+			}
+			src = bytes.NewReader(data)
+		}
+
+		if isVoice {
+			data, err := io.ReadAll(io.LimitReader(src, maxVoiceNoteSize+1))
+			if err != nil {
+				http.Error(w, "Failed to read file: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if len(data) > maxVoiceNoteSize {
+				http.Error(w, "Voice note too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			voice, err = newVoiceNote(data, contentType, filename, r.FormValue("duration"), r.FormValue("waveform"))
+			if err != nil {
+				http.Error(w, "Invalid voice note: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			src = bytes.NewReader(data)
+		}
+
+		if viewOnce {
+			blob.File, blob.Size, err = storeViewOnce(src, filename)
+		} else {
+			blob, err = storeBlob(src, filename)
+		}
+		if err != nil {
 			http.Error(w, "Failed to save file: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 	}
 
+	var msgType string
+	if src != nil {
+		msgType = MessageTypeDocument
+		if isImage {
+			msgType = MessageTypeImage
+		} else if isVoice {
+			msgType = MessageTypeVoice
+		}
+	}
+
 	msg := Message{
-		MessageID: generateMessageID(),
-		ChatID:    chatID,
-		Content:   content,
-		Caption:   caption,
-		File:      filename,
-		Sender:    claims.UserID, // Replace with actual user data.
-		CreatedAt: time.Now(),
+		MessageID:    generateMessageID(),
+		ChatID:       chatID,
+		Type:         msgType,
+		Content:      content,
+		Mentions:     mentions,
+		Caption:      caption,
+		ReplyTo:      replyTo,
+		ThreadID:     r.FormValue("thread_id"),
+		File:         blob.File,
+		BlobHash:     blob.Hash,
+		Size:         blob.Size,
+		OriginalName: filename,
+		AsDocument:   asDocument && src != nil,
+		ViewOnce:     viewOnce,
+		Voice:        voice,
+		Sender:       claims.UserID, // Replace with actual user data.
+		CreatedAt:    time.Now(),
 	}
 
-	if err := saveMessage(msg); err != nil {
+	msg.Text, msg.Entities = formatText(msg.Content, msg.Mentions)
+
+	var response interface{} = msg
+	if !sendAt.IsZero() {
+		scheduled, err := scheduleMessage(msg, sendAt)
+		if err != nil {
+			releaseMessageMedia(msg)
+			http.Error(w, "Failed to schedule message", http.StatusInternalServerError)
+			return
+		}
+		response = scheduled
+	} else if err := deliverMessage(&msg); err != nil {
+		releaseMessageMedia(msg)
 		http.Error(w, "Failed to save message", http.StatusInternalServerError)
 		return
 	}
 
+	if upload != nil {
+		if err := removeUpload(*upload); err != nil {
+			log.Println("Failed to remove attached upload:", upload.UploadID, err)
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(msg)
+	json.NewEncoder(w).Encode(response)
 }
 
 // Edit a message in the database
@@ -148,7 +445,6 @@ func editMessageHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Par
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	_ = claims
 
 	if r.Method != http.MethodPut {
 		http.Error(w, "Invalid Method", http.StatusMethodNotAllowed)
@@ -156,17 +452,51 @@ func editMessageHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Par
 	}
 
 	var req struct {
-		ChatID     string `json:"chat_id"`
-		MessageID  string `json:"message_id"`
-		NewContent string `json:"new_content"`
+		ChatID     string    `json:"chat_id"`
+		MessageID  string    `json:"message_id"`
+		NewContent string    `json:"new_content"`
+		Mentions   []Mention `json:"mentions"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request data", http.StatusBadRequest)
 		return
 	}
 
+	if req.NewContent, err = sanitizeText(req.NewContent, maxContentLength); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	original, err := getMessage(req.ChatID, req.MessageID)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch message", http.StatusInternalServerError)
+		return
+	}
+	if original.Sender != claims.UserID {
+		http.Error(w, "Only the sender can edit a message", http.StatusForbidden)
+		return
+	}
+	mentions, err := chatMentions(req.ChatID, req.NewContent, req.Mentions)
+	if isMentionError(err) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err == mongo.ErrNoDocuments {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to check mentions", http.StatusInternalServerError)
+		return
+	}
+
+	text, entities := formatText(req.NewContent, mentions)
 	update := bson.M{
 		"content":   req.NewContent,
+		"mentions":  mentions,
+		"text":      text,
+		"entities":  entities,
 		"edited_at": time.Now(),
 	}
 
@@ -175,16 +505,39 @@ func editMessageHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Par
 		return
 	}
 
+	if edited, err := getMessage(req.ChatID, req.MessageID); err == nil {
+		refreshQuotes(edited)
+		// Users newly mentioned by the edit are notified like on a send.
+		for _, userID := range recordMentions(edited, original.Mentions) {
+			sendNotification(edited, userID, true)
+		}
+		// A preview of a link the edit removed goes; a new link gets its own.
+		if edited.LinkPreview != nil && edited.LinkPreview.URL != previewLink(edited) {
+			unset := bson.M{"$unset": bson.M{"link_preview": ""}}
+			if _, err := messagesCollection.UpdateOne(ctx, bson.M{"chat_id": req.ChatID, "message_id": req.MessageID}, unset); err != nil {
+				log.Println("Failed to remove link preview:", req.MessageID, err)
+			}
+			edited.LinkPreview = nil
+		}
+		enqueueLinkPreview(edited)
+	}
+
 	wsMessage := struct {
-		Type       string `json:"type"`
-		ChatID     string `json:"chat_id"`
-		MessageID  string `json:"message_id"`
-		NewContent string `json:"new_content"`
+		Type       string       `json:"type"`
+		ChatID     string       `json:"chat_id"`
+		MessageID  string       `json:"message_id"`
+		NewContent string       `json:"new_content"`
+		Mentions   []Mention    `json:"mentions,omitempty"`
+		Text       string       `json:"text,omitempty"`
+		Entities   []TextEntity `json:"entities,omitempty"`
 	}{
 		Type:       "edit",
 		ChatID:     req.ChatID,
 		MessageID:  req.MessageID,
 		NewContent: req.NewContent,
+		Mentions:   mentions,
+		Text:       text,
+		Entities:   entities,
 	}
 	wsBroadcast(req.ChatID, wsMessage)
 
@@ -220,10 +573,14 @@ func deleteMessageHandler(w http.ResponseWriter, r *http.Request, _ httprouter.P
 	log.Println("rdhfyer8i748547--------------", req)
 	update := bson.M{"deleted": true}
 
-	if err := updateMessage(req.ChatID, req.MessageID, update); err != nil {
+	deleted, err := softDeleteMessage(req.ChatID, req.MessageID)
+	if err != nil {
 		http.Error(w, "Failed to delete message", http.StatusInternalServerError)
 		return
 	}
+	if deleted != nil {
+		releaseMessageMedia(*deleted)
+	}
 
 	// wsMessage := struct {
 	// 	Type      string `json:"type"`
@@ -244,25 +601,6 @@ func deleteMessageHandler(w http.ResponseWriter, r *http.Request, _ httprouter.P
 
 // --- Helper Functions ---
 
-func saveUploadedFile(file io.Reader, filename string) error {
-	uploadDir := "./uploads"
-	if _, err := os.Stat(uploadDir); os.IsNotExist(err) {
-		if err := os.Mkdir(uploadDir, os.ModePerm); err != nil {
-			return err
-		}
-	}
-
-	dstPath := fmt.Sprintf("%s/%s", uploadDir, filename)
-	dst, err := os.Create(dstPath)
-	if err != nil {
-		return err
-	}
-	defer dst.Close()
-
-	_, err = io.Copy(dst, file)
-	return err
-}
-
 func generateMessageID() string {
 	// return fmt.Sprintf("%d", time.Now().UnixNano()) // Replace with a proper unique ID generator
 	return utils.GenerateIntID(18)
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"nwr/utils"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Link previews: the first link of a text message is fetched in the background, and the
+// page's title, description and image are attached to the message as LinkPreview and
+// broadcast in a "link_preview" event. Previews are cached in Redis by URL, so a link
+// shared in many chats is fetched once.
+
+const (
+	linkPreviewTTL        = 24 * time.Hour
+	linkPreviewFailureTTL = time.Hour // Pages without a preview aren't asked again for a while.
+	linkPreviewTimeout    = 10 * time.Second
+	previewImageDir       = "previews" // Under uploadDir.
+	previewImageWidth     = 600
+	previewImageHeight    = 600
+	// Remote images with more pixels than this aren't decoded.
+	previewImageMaxPixels = 16_000_000
+)
+
+var linkPreviewsEnabled = utils.EnvBool("LINK_PREVIEWS", true)
+
+// The fetcher used for previews; replaced with one allowing local addresses to test
+// against an httptest server.
+var linkFetcher = utils.NewLinkFetcher(utils.FetcherOptions{
+	UserAgent: "Mozilla/5.0 (compatible; nwr-linkpreview/1.0)",
+})
+
+type LinkPreview struct {
+	URL         string `json:"url" bson:"url"` // The link in the message.
+	Title       string `json:"title,omitempty" bson:"title,omitempty"`
+	Description string `json:"description,omitempty" bson:"description,omitempty"`
+	SiteName    string `json:"site_name,omitempty" bson:"site_name,omitempty"`
+	Image       string `json:"image,omitempty" bson:"image,omitempty"`
+	ImageWidth  int    `json:"image_width,omitempty" bson:"image_width,omitempty"`
+	ImageHeight int    `json:"image_height,omitempty" bson:"image_height,omitempty"`
+}
+
+func (p LinkPreview) empty() bool {
+	return p.Title == "" && p.Description == "" && p.Image == ""
+}
+
+type linkPreviewJob struct {
+	ChatID    string
+	MessageID string
+	URL       string
+}
+
+var linkPreviewJobs = make(chan linkPreviewJob, 256)
+
+// Start n workers that fetch link previews.
+func startLinkPreviewWorkers(n int) {
+	for i := 0; i < n; i++ {
+		go func() {
+			for job := range linkPreviewJobs {
+				processLinkPreview(job)
+			}
+		}()
+	}
+}
+
+// The link a message is previewed with: its first, outside code.
+func previewLink(msg Message) string {
+	if msg.Type != "" || msg.ViewOnce {
+		return ""
+	}
+	for _, e := range msg.Entities {
+		if e.Type == EntityURL {
+			return e.URL
+		}
+	}
+	return ""
+}
+
+// Queue the message's link, if it has one and no preview yet, for a preview.
+func enqueueLinkPreview(msg Message) {
+	link := previewLink(msg)
+	if !linkPreviewsEnabled || link == "" || (msg.LinkPreview != nil && msg.LinkPreview.URL == link) {
+		return
+	}
+	select {
+	case linkPreviewJobs <- linkPreviewJob{ChatID: msg.ChatID, MessageID: msg.MessageID, URL: link}:
+	default:
+		log.Println("Link preview queue full, skipping:", link)
+	}
+}
+
+func linkPreviewKey(hash string) string {
+	return "linkpreview:" + hash
+}
+
+func urlHash(link string) string {
+	sum := sha256.Sum256([]byte(link))
+	return hex.EncodeToString(sum[:])
+}
+
+// Fetch the preview of link, from the cache when it was fetched recently.
+func getLinkPreview(link string) (LinkPreview, error) {
+	hash := urlHash(link)
+	if cached, err := redisClient.Get(ctx, linkPreviewKey(hash)).Bytes(); err == nil {
+		var preview LinkPreview
+		if err := json.Unmarshal(cached, &preview); err == nil {
+			return preview, nil
+		}
+	}
+
+	preview, err := fetchLinkPreview(link, hash)
+	ttl := linkPreviewTTL
+	if err != nil || preview.empty() {
+		ttl = linkPreviewFailureTTL
+	}
+	if data, err := json.Marshal(preview); err == nil {
+		redisClient.Set(ctx, linkPreviewKey(hash), data, ttl)
+	}
+	return preview, err
+}
+
+func fetchLinkPreview(link, hash string) (LinkPreview, error) {
+	fetchCtx, cancel := context.WithTimeout(ctx, linkPreviewTimeout)
+	defer cancel()
+
+	preview := LinkPreview{URL: link}
+	meta, err := linkFetcher.FetchMetadata(fetchCtx, link)
+	if err != nil {
+		return preview, err
+	}
+	preview.Title, preview.Description, preview.SiteName = meta.Title, meta.Description, meta.SiteName
+
+	if meta.ImageURL != "" {
+		if image, w, h, err := savePreviewImage(fetchCtx, meta.ImageURL, hash); err != nil {
+			log.Println("Link preview image error:", meta.ImageURL, err)
+		} else {
+			preview.Image, preview.ImageWidth, preview.ImageHeight = image, w, h
+		}
+	}
+	return preview, nil
+}
+
+// Fetch a page's preview image and store it scaled down, re-encoded as JPEG so nothing
+// but pixels from the remote server is served back.
+func savePreviewImage(fetchCtx context.Context, imageURL, hash string) (string, int, int, error) {
+	data, _, err := linkFetcher.FetchImage(fetchCtx, imageURL)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	if err := utils.CheckImagePixels(data, previewImageMaxPixels); err != nil {
+		return "", 0, 0, err
+	}
+	img, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
+	if err != nil {
+		return "", 0, 0, err
+	}
+	img = imaging.Fit(img, previewImageWidth, previewImageHeight, imaging.Lanczos)
+
+	dir := filepath.Join(uploadDir, previewImageDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", 0, 0, err
+	}
+	name := hash + ".jpg"
+	if err := imaging.Save(img, filepath.Join(dir, name), imaging.JPEGQuality(85)); err != nil {
+		return "", 0, 0, err
+	}
+	return mediaURL(previewImageDir, name), img.Bounds().Dx(), img.Bounds().Dy(), nil
+}
+
+// Names of the preview images shown by messages that have not been deleted.
+func livePreviewImages() (map[string]bool, error) {
+	images := make(map[string]bool)
+
+	opts := options.Find().SetProjection(bson.M{"link_preview.image": 1})
+	cur, err := messagesCollection.Find(ctx, bson.M{"deleted": false, "link_preview.image": bson.M{"$exists": true, "$ne": ""}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var msg Message
+		if err := cur.Decode(&msg); err != nil {
+			log.Println("Decode message error:", err)
+			continue
+		}
+		images[path.Base(msg.LinkPreview.Image)] = true
+	}
+	return images, cur.Err()
+}
+
+// Fetch a preview and attach it to its message, unless the message changed link meanwhile.
+func processLinkPreview(job linkPreviewJob) {
+	preview, err := getLinkPreview(job.URL)
+	if err != nil {
+		log.Println("Link preview error:", job.URL, err)
+		return
+	}
+	if preview.empty() {
+		return
+	}
+
+	filter := bson.M{"chat_id": job.ChatID, "message_id": job.MessageID, "deleted": false, "entities": bson.M{"$elemMatch": bson.M{"type": EntityURL, "url": job.URL}}}
+	res, err := messagesCollection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"link_preview": preview}})
+	if err != nil {
+		log.Println("Failed to record link preview:", job.MessageID, err)
+		return
+	}
+	if res.MatchedCount == 0 {
+		return
+	}
+
+	wsMessage := struct {
+		Type        string      `json:"type"`
+		ChatID      string      `json:"chat_id"`
+		MessageID   string      `json:"message_id"`
+		LinkPreview LinkPreview `json:"link_preview"`
+	}{
+		Type:        "link_preview",
+		ChatID:      job.ChatID,
+		MessageID:   job.MessageID,
+		LinkPreview: preview,
+	}
+	wsBroadcast(job.ChatID, wsMessage)
+}
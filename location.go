@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"nwr/utils"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Location messages carry a single position. Live locations keep being updated by the sender
+// over the WebSocket ("location" frames) until they stop sharing or the share expires.
+
+const MessageTypeLocation = "location"
+
+const (
+	maxPlaceName        = 100 // Characters.
+	minLiveLocationTime = time.Minute
+	maxLiveLocationTime = 8 * time.Hour
+)
+
+type Location struct {
+	Latitude  float64 `json:"latitude" bson:"latitude"`
+	Longitude float64 `json:"longitude" bson:"longitude"`
+	Accuracy  float64 `json:"accuracy,omitempty" bson:"accuracy,omitempty"` // Meters.
+	Name      string  `json:"name,omitempty" bson:"name,omitempty"`
+
+	// Set on live locations.
+	LiveUntil *time.Time `json:"live_until,omitempty" bson:"live_until,omitempty"`
+	UpdatedAt *time.Time `json:"updatedat,omitempty" bson:"updatedat,omitempty"`
+	StoppedAt *time.Time `json:"stoppedat,omitempty" bson:"stoppedat,omitempty"`
+}
+
+func (l *Location) validate() error {
+	if math.IsNaN(l.Latitude) || l.Latitude < -90 || l.Latitude > 90 {
+		return errors.New("latitude must be between -90 and 90")
+	}
+	if math.IsNaN(l.Longitude) || l.Longitude < -180 || l.Longitude > 180 {
+		return errors.New("longitude must be between -180 and 180")
+	}
+	if math.IsNaN(l.Accuracy) || l.Accuracy < 0 {
+		return errors.New("accuracy must be positive")
+	}
+	name, err := sanitizeText(strings.TrimSpace(l.Name), maxPlaceName)
+	if err != nil {
+		return errors.New("name: " + err.Error())
+	}
+	l.Name = name
+	return nil
+}
+
+// Filter matching a live location that is still being shared by userID.
+func activeLiveLocationFilter(messageID, userID string, now time.Time) bson.M {
+	return bson.M{
+		"message_id":          messageID,
+		"sender":              userID,
+		"deleted":             false,
+		"location.live_until": bson.M{"$gt": now},
+		"location.stoppedat":  bson.M{"$exists": false},
+	}
+}
+
+func broadcastLocation(msg Message) {
+	wsMessage := struct {
+		Type      string    `json:"type"`
+		ChatID    string    `json:"chat_id"`
+		MessageID string    `json:"message_id"`
+		Location  *Location `json:"location"`
+	}{
+		Type:      "location",
+		ChatID:    msg.ChatID,
+		MessageID: msg.MessageID,
+		Location:  msg.Location,
+	}
+	wsBroadcast(msg.ChatID, wsMessage)
+}
+
+// Record a new position for a live location and push it to the chat.
+func updateLiveLocation(messageID, userID string, pos Location) error {
+	if err := pos.validate(); err != nil {
+		return err
+	}
+	now := time.Now()
+	update := bson.M{"$set": bson.M{
+		"location.latitude":  pos.Latitude,
+		"location.longitude": pos.Longitude,
+		"location.accuracy":  pos.Accuracy,
+		"location.updatedat": now,
+	}}
+
+	var msg Message
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := messagesCollection.FindOneAndUpdate(ctx, activeLiveLocationFilter(messageID, userID, now), update, opts).Decode(&msg)
+	if err == mongo.ErrNoDocuments {
+		return errors.New("live location not found or no longer shared")
+	} else if err != nil {
+		return err
+	}
+	broadcastLocation(msg)
+	return nil
+}
+
+// Stop sharing a live location before it expires.
+func stopLiveLocation(messageID, userID string) error {
+	now := time.Now()
+	var msg Message
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := messagesCollection.FindOneAndUpdate(ctx, activeLiveLocationFilter(messageID, userID, now),
+		bson.M{"$set": bson.M{"location.stoppedat": now}}, opts).Decode(&msg)
+	if err == mongo.ErrNoDocuments {
+		return errors.New("live location not found or no longer shared")
+	} else if err != nil {
+		return err
+	}
+	broadcastLocation(msg)
+	return nil
+}
+
+// Stop live locations whose sharing time has run out and let the chats know.
+func stopExpiredLiveLocations() {
+	now := time.Now()
+	for {
+		var msg Message
+		err := messagesCollection.FindOneAndUpdate(ctx,
+			bson.M{"location.live_until": bson.M{"$lte": now}, "location.stoppedat": bson.M{"$exists": false}},
+			[]bson.M{{"$set": bson.M{"location.stoppedat": "$location.live_until"}}},
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&msg)
+		if err == mongo.ErrNoDocuments {
+			return
+		} else if err != nil {
+			log.Println("Live location expiry error:", err)
+			return
+		}
+		if !msg.Deleted && msg.Location != nil {
+			broadcastLocation(msg)
+		}
+	}
+}
+
+// Handle a "location" or "location_stop" frame from a client sharing its live location.
+func handleLocationFrame(c *wsClient, frame wsFrame) error {
+	var data struct {
+		MessageID string `json:"message_id"`
+		Location
+	}
+	if err := json.Unmarshal(frame.Data, &data); err != nil || data.MessageID == "" {
+		return errors.New("invalid location data")
+	}
+	// The sender may have left the chat since they started sharing.
+	if _, err := getMemberMessage(data.MessageID, c.userID); err != nil {
+		return errors.New("live location not found")
+	}
+	if frame.Type == "location_stop" {
+		return stopLiveLocation(data.MessageID, c.userID)
+	}
+	return updateLiveLocation(data.MessageID, c.userID, data.Location)
+}
+
+// --- Handlers ---
+
+// Share a location in a chat. With live_for (seconds) the location is live: the sender
+// streams updates over the WebSocket until it expires or is stopped.
+func sendLocationHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Location
+		LiveFor int64 `json:"live_for"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request data", http.StatusBadRequest)
+		return
+	}
+	if err := req.Location.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	liveFor := time.Duration(req.LiveFor) * time.Second
+	if req.LiveFor != 0 && (liveFor < minLiveLocationTime || liveFor > maxLiveLocationTime) {
+		http.Error(w, "live_for must be between 1 minute and 8 hours", http.StatusBadRequest)
+		return
+	}
+
+	chat, err := getMemberChat(ps.ByName("chatid"), claims.UserID)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch chat", http.StatusInternalServerError)
+		return
+	}
+
+	loc := Location{
+		Latitude:  req.Latitude,
+		Longitude: req.Longitude,
+		Accuracy:  req.Accuracy,
+		Name:      req.Name,
+	}
+	msg := Message{
+		MessageID: generateMessageID(),
+		ChatID:    chat.ChatID,
+		Type:      MessageTypeLocation,
+		Sender:    claims.UserID,
+		Content:   req.Name,
+		Location:  &loc,
+		CreatedAt: time.Now(),
+	}
+	if liveFor > 0 {
+		liveUntil, updatedAt := msg.CreatedAt.Add(liveFor), msg.CreatedAt
+		loc.LiveUntil, loc.UpdatedAt = &liveUntil, &updatedAt
+	}
+
+	if err := deliverMessage(&msg); err != nil {
+		http.Error(w, "Failed to save location", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msg)
+}
@@ -8,6 +8,7 @@ import (
 	"nwr/middleware"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -34,6 +35,27 @@ func securityHeaders(next http.Handler) http.Handler {
 	})
 }
 
+// Answer requests the main router only has routes for under other methods: the fallback
+// router may have a route for the method asked for, or else its methods count towards the
+// Allow header of the 405.
+func methodNotAllowed(fallback *httprouter.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handle, ps, _ := fallback.Lookup(r.Method, r.URL.Path); handle != nil {
+			w.Header().Del("Allow")
+			handle(w, r, ps)
+			return
+		}
+		allow := w.Header().Get("Allow")
+		for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+			if handle, _, _ := fallback.Lookup(method, r.URL.Path); handle != nil && !strings.Contains(allow, method) {
+				allow += ", " + method
+			}
+		}
+		w.Header().Set("Allow", allow)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	})
+}
+
 func main() {
 	// Initialize MongoDB.
 	var err error
@@ -45,6 +67,19 @@ func main() {
 	db = mongoClient.Database("chatxapp")
 	chatsCollection = db.Collection("chats")
 	messagesCollection = db.Collection("messages")
+	uploadsCollection = db.Collection("uploads")
+	blobsCollection = db.Collection("blobs")
+	starsCollection = db.Collection("stars")
+	scheduledCollection = db.Collection("scheduled_messages")
+	storageHoldsCollection = db.Collection("storage_holds")
+	contactsCollection = db.Collection("contacts")
+
+	if err = ensureSearchIndex(); err != nil {
+		log.Println("Failed to create search index:", err)
+	}
+	if err = ensureStarIndex(); err != nil {
+		log.Println("Failed to create stars index:", err)
+	}
 
 	// Initialize Redis.
 	redisClient = redis.NewClient(&redis.Options{
@@ -57,6 +92,24 @@ func main() {
 	// Start the background flushing process.
 	go flushRedisMessages()
 
+	// Deliver scheduled messages when they are due.
+	go runScheduler()
+
+	// Remove messages whose disappearing timer ran out.
+	go runReaper()
+
+	// Start the image thumbnail/rendition workers.
+	startMediaWorkers(4)
+
+	// Start the link preview fetchers.
+	startLinkPreviewWorkers(2)
+
+	// Clean up abandoned resumable uploads.
+	go expireUploads()
+
+	// Periodically remove media no message refers to.
+	go runUploadGC()
+
 	router := httprouter.New()
 
 	// Health check.
@@ -64,22 +117,71 @@ func main() {
 
 	// Existing endpoints.
 	router.GET("/api/contacts", middleware.Authenticate(contactsHandler))
+	router.POST("/api/contacts/import", middleware.Authenticate(importContactsHandler))
+	router.GET("/api/contacts/export", middleware.Authenticate(exportContactsHandler))
 	router.GET("/api/chats", middleware.Authenticate(chatsHandler))
 	router.GET("/api/messages", middleware.Authenticate(messagesHandler))
 	router.POST("/api/messages/send", middleware.Authenticate(sendMessageHandler))
+	router.POST("/api/messages/forward", middleware.Authenticate(forwardMessageHandler))
+	router.POST("/api/messages/format", middleware.Authenticate(formatTextHandler))
+	router.GET("/api/messages/scheduled", middleware.Authenticate(scheduledMessagesHandler))
+	router.PUT("/api/messages/scheduled/:id", middleware.Authenticate(editScheduledMessageHandler))
+	router.DELETE("/api/messages/scheduled/:id", middleware.Authenticate(cancelScheduledMessageHandler))
 	router.PUT("/api/messages/edit", middleware.Authenticate(editMessageHandler))
 	router.DELETE("/api/messages/delete", middleware.Authenticate(deleteMessageHandler))
 	router.DELETE("/api/chats/:chatid", middleware.Authenticate(deleteChatHandler))
+	router.GET("/api/chats/:chatid/media", middleware.Authenticate(chatMediaHandler))
+	router.GET("/api/chats/:chatid/pins", middleware.Authenticate(pinsHandler))
+	router.DELETE("/api/chats/:chatid/pins/:messageid", middleware.Authenticate(unpinMessageHandler))
+	router.PUT("/api/chats/:chatid/disappearing", middleware.Authenticate(disappearingHandler))
+	router.PUT("/api/chats/:chatid/mute", middleware.Authenticate(muteChatHandler))
+	router.DELETE("/api/chats/:chatid/mute", middleware.Authenticate(unmuteChatHandler))
+	router.GET("/api/search", middleware.Authenticate(searchHandler))
+	router.GET("/api/starred", middleware.Authenticate(starredHandler))
 	router.GET("/ws", wsHandler)
 
+	// Routes keyed by an ID under a prefix that also has static routes (e.g. /api/messages/edit)
+	// can't share httprouter's tree, so they live on a second router that handles whatever the
+	// main one doesn't match, including paths the main one knows under other methods only.
+	idRouter := httprouter.New()
+	idRouter.PUT("/api/messages/:id/reactions", middleware.Authenticate(putReactionHandler))
+	idRouter.DELETE("/api/messages/:id/reactions", middleware.Authenticate(deleteReactionHandler))
+	idRouter.GET("/api/messages/:id/thread", middleware.Authenticate(threadHandler))
+	idRouter.GET("/api/messages/:id/media", middleware.Authenticate(viewOnceMediaHandler))
+	idRouter.POST("/api/chats/:chatid/pins", middleware.Authenticate(pinMessageHandler))
+	idRouter.POST("/api/chats/:chatid/polls", middleware.Authenticate(createPollHandler))
+	idRouter.POST("/api/chats/:chatid/location", middleware.Authenticate(sendLocationHandler))
+	idRouter.POST("/api/chats/:chatid/contact", middleware.Authenticate(sendContactHandler))
+	idRouter.PUT("/api/messages/:id/poll/vote", middleware.Authenticate(votePollHandler))
+	idRouter.POST("/api/messages/:id/poll/close", middleware.Authenticate(closePollHandler))
+	idRouter.PUT("/api/messages/:id/played", middleware.Authenticate(playedVoiceHandler))
+	idRouter.PUT("/api/messages/:id/star", middleware.Authenticate(starMessageHandler))
+	idRouter.DELETE("/api/messages/:id/star", middleware.Authenticate(unstarMessageHandler))
+	router.NotFound = idRouter
+	router.MethodNotAllowed = methodNotAllowed(idRouter)
+
+	// Resumable (tus) uploads.
+	router.OPTIONS("/api/uploads", tusOptionsHandler)
+	router.POST("/api/uploads", middleware.Authenticate(createUploadHandler))
+	router.HEAD("/api/uploads/:id", middleware.Authenticate(headUploadHandler))
+	router.PATCH("/api/uploads/:id", middleware.Authenticate(patchUploadHandler))
+	router.DELETE("/api/uploads/:id", middleware.Authenticate(deleteUploadHandler))
+
+	// Storage usage and maintenance.
+	router.GET("/api/storage", middleware.Authenticate(storageHandler))
+	router.DELETE("/api/storage/media", middleware.Authenticate(deleteMediaHandler))
+	router.GET("/api/admin/gc", middleware.Authenticate(gcReportHandler))
+	router.POST("/api/admin/gc", middleware.Authenticate(gcHandler))
+
 	// Register the new create chat endpoint.
 	router.POST("/api/chats/create", createChatHandler)
 
 	// CORS setup.
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Content-Type", "Authorization"},
+		AllowedMethods:   []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization", "Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Metadata"},
+		ExposedHeaders:   []string{"Location", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size", "Upload-Offset", "Upload-Length", "Upload-Expires"},
 		AllowCredentials: true,
 	})
 	handler := securityHeaders(c.Handler(router))
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"log"
+	"nwr/utils"
+	"path/filepath"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const uploadDir = "./uploads"
+
+// Thumbnail and rendition sizes generated for image messages.
+const (
+	thumbWidth  = 300
+	thumbHeight = 200
+	// Images are read into memory to strip their metadata; larger ones go as documents.
+	maxImageUploadSize = 32 << 20
+)
+
+var imageRenditions = []struct {
+	Name      string
+	MaxWidth  int
+	MaxHeight int
+}{
+	{Name: "small", MaxWidth: 320, MaxHeight: 320},
+	{Name: "medium", MaxWidth: 1280, MaxHeight: 1280},
+}
+
+// A mediaJob asks the worker pool to post-process an uploaded image.
+type mediaJob struct {
+	ChatID    string
+	MessageID string
+	File      string
+}
+
+var mediaJobs = make(chan mediaJob, 256)
+
+// Start n workers that generate thumbnails and renditions for uploaded images.
+func startMediaWorkers(n int) {
+	for i := 0; i < n; i++ {
+		go func() {
+			for job := range mediaJobs {
+				processImage(job)
+			}
+		}()
+	}
+}
+
+// Queue an image for processing without blocking the request.
+func enqueueMediaJob(job mediaJob) {
+	select {
+	case mediaJobs <- job:
+	default:
+		log.Println("Media queue full, skipping:", job.File)
+	}
+}
+
+func isImageUpload(contentType, filename string) bool {
+	if utils.SupportedImageTypes[contentType] {
+		return true
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".bmp", ".tif", ".tiff":
+		return true
+	}
+	return false
+}
+
+// Whether ext is a way of writing the image extension want (".jpg" or ".png").
+func sameImageExtension(ext, want string) bool {
+	ext = strings.ToLower(ext)
+	return ext == want || (want == ".jpg" && ext == ".jpeg")
+}
+
+func mediaURL(parts ...string) string {
+	return "/uploads/" + strings.Join(parts, "/")
+}
+
+// Generate the thumbnail, renditions and placeholder for an image and record them on its message.
+func processImage(job mediaJob) {
+	ext := filepath.Ext(job.File)
+	name := strings.TrimSuffix(job.File, ext)
+
+	width, height, err := utils.ImageSize(filepath.Join(uploadDir, job.File))
+	if err != nil {
+		log.Println("Image decode error:", job.File, err)
+		return
+	}
+
+	update := bson.M{"width": width, "height": height}
+
+	if hash, color, err := utils.ImagePlaceholder(filepath.Join(uploadDir, job.File)); err != nil {
+		log.Println("BlurHash error:", job.File, err)
+	} else {
+		update["blurhash"] = hash
+		update["dominant_color"] = color
+	}
+
+	if err := utils.CreateThumb(name, uploadDir, ext, thumbWidth, thumbHeight); err != nil {
+		log.Println("Thumbnail error:", job.File, err)
+	} else {
+		update["thumbnail"] = mediaURL("thumb", job.File)
+	}
+
+	var renditions []Rendition
+	for _, r := range imageRenditions {
+		// Skip renditions that would be no smaller than the original.
+		if width <= r.MaxWidth && height <= r.MaxHeight {
+			continue
+		}
+		w, h, err := utils.CreateRendition(name, uploadDir, ext, r.Name, r.MaxWidth, r.MaxHeight)
+		if err != nil {
+			log.Println("Rendition error:", job.File, r.Name, err)
+			continue
+		}
+		renditions = append(renditions, Rendition{
+			Name:   r.Name,
+			URL:    mediaURL(r.Name, job.File),
+			Width:  w,
+			Height: h,
+		})
+	}
+	if len(renditions) > 0 {
+		update["renditions"] = renditions
+	}
+
+	if err := updateMessage(job.ChatID, job.MessageID, update); err != nil {
+		log.Println("Failed to record image metadata:", job.MessageID, err)
+		return
+	}
+
+	wsMessage := struct {
+		Type      string `json:"type"`
+		ChatID    string `json:"chat_id"`
+		MessageID string `json:"message_id"`
+		Media     bson.M `json:"media"`
+	}{
+		Type:      "media_ready",
+		ChatID:    job.ChatID,
+		MessageID: job.MessageID,
+		Media:     update,
+	}
+	wsBroadcast(job.ChatID, wsMessage)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"nwr/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Filter matching the live chats a user belongs to. Chats created before members were
+// recorded, which have none, stay open to everyone, as they were before. isChatMember
+// applies the same rule to a chat already fetched.
+func memberChatsFilter(userID string) bson.M {
+	return bson.M{
+		"deleted": bson.M{"$ne": true},
+		"$or": []bson.M{
+			{"members": userID},
+			{"members": nil}, // Missing or null.
+			{"members": bson.M{"$size": 0}},
+		},
+	}
+}
+
+// Whether the user belongs to the chat, by the rule of memberChatsFilter.
+func isChatMember(chat Chat, userID string) bool {
+	return len(chat.Members) == 0 || utils.Contains(chat.Members, userID)
+}
+
+// IDs of the chats a user belongs to.
+func userChatIDs(userID string) ([]string, error) {
+	opts := options.Find().SetProjection(bson.M{"chat_id": 1})
+	cur, err := chatsCollection.Find(ctx, memberChatsFilter(userID), opts)
+	if err != nil {
+		return nil, err
+	}
+	var chats []Chat
+	if err := cur.All(ctx, &chats); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(chats))
+	for _, c := range chats {
+		ids = append(ids, c.ChatID)
+	}
+	return ids, nil
+}
+
+// Fetch a chat if the user belongs to it.
+func getMemberChat(chatID, userID string) (Chat, error) {
+	filter := memberChatsFilter(userID)
+	filter["chat_id"] = chatID
+	var chat Chat
+	err := chatsCollection.FindOne(ctx, filter).Decode(&chat)
+	return chat, err
+}
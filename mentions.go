@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"nwr/utils"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/go-redis/redis/v8"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Mentions point at chat members from a message's Content, either as "@handle" in the text
+// or as entities sent by the client. Offsets and lengths count UTF-16 code units, as
+// JavaScript strings do. Mentioned users get their own unread counter per chat and are
+// notified even when they muted the chat.
+
+type Mention struct {
+	UserID string `json:"user_id" bson:"user_id"`
+	Offset int    `json:"offset" bson:"offset"`
+	Length int    `json:"length" bson:"length"`
+}
+
+// Redis hash of lower-cased usernames to user IDs, learned from the tokens users connect with.
+const handlesKey = "user:handles"
+
+var handlePattern = regexp.MustCompile(`@([A-Za-z0-9_.]{1,32})`)
+
+// Errors returned for mentions a client got wrong.
+var (
+	errMentionOutOfRange = errors.New("mention is outside the message text")
+	errMentionNotMember  = errors.New("mentioned user is not a member of this chat")
+	errMentionsOverlap   = errors.New("mentions overlap")
+)
+
+func isMentionError(err error) bool {
+	return err == errMentionOutOfRange || err == errMentionNotMember || err == errMentionsOverlap
+}
+
+func mentionUnreadKey(chatID string) string {
+	return "chat:" + chatID + ":mentions"
+}
+
+func rememberHandle(username, userID string) {
+	if username == "" || userID == "" {
+		return
+	}
+	if err := redisClient.HSet(ctx, handlesKey, strings.ToLower(username), userID).Err(); err != nil {
+		log.Println("Failed to record handle:", err)
+	}
+}
+
+// Length of s in UTF-16 code units.
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n += utf16.RuneLen(r)
+	}
+	return n
+}
+
+// Validate the client's mention entities and add the "@handle" mentions found in content.
+// Handles that don't resolve to a member of the chat are left as plain text.
+func parseMentions(chat Chat, content string, entities []Mention) ([]Mention, error) {
+	length := utf16Len(content)
+	var mentions []Mention
+	for _, m := range entities {
+		if m.UserID == "" || m.Offset < 0 || m.Length <= 0 || m.Offset+m.Length > length {
+			return nil, errMentionOutOfRange
+		}
+		if !isChatMember(chat, m.UserID) {
+			return nil, errMentionNotMember
+		}
+		mentions = append(mentions, Mention{UserID: m.UserID, Offset: m.Offset, Length: m.Length})
+	}
+
+	for _, loc := range handlePattern.FindAllStringSubmatchIndex(content, -1) {
+		start := loc[0]
+		// Skip e-mail addresses and the like.
+		if r, _ := utf8.DecodeLastRuneInString(content[:start]); start > 0 && (r == '@' || r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			continue
+		}
+		handle := strings.TrimRight(content[loc[2]:loc[3]], ".")
+		if handle == "" {
+			continue
+		}
+		end := loc[2] + len(handle)
+
+		userID, err := redisClient.HGet(ctx, handlesKey, strings.ToLower(handle)).Result()
+		if err == redis.Nil && utils.Contains(chat.Members, handle) {
+			userID, err = handle, nil // Members can also be mentioned by ID.
+		}
+		if err != nil || !isChatMember(chat, userID) {
+			continue
+		}
+
+		m := Mention{UserID: userID, Offset: utf16Len(content[:start]), Length: utf16Len(content[start:end])}
+		if !overlapsMention(mentions, m) {
+			mentions = append(mentions, m)
+		}
+	}
+
+	sort.Slice(mentions, func(i, j int) bool { return mentions[i].Offset < mentions[j].Offset })
+	for i := range mentions {
+		if overlapsMention(mentions[:i], mentions[i]) {
+			return nil, errMentionsOverlap
+		}
+	}
+	return mentions, nil
+}
+
+func overlapsMention(mentions []Mention, m Mention) bool {
+	for _, o := range mentions {
+		if m.Offset < o.Offset+o.Length && o.Offset < m.Offset+m.Length {
+			return true
+		}
+	}
+	return false
+}
+
+// Users mentioned in a message, once each, leaving out the sender.
+func mentionedUsers(msg Message) []string {
+	var users []string
+	for _, m := range msg.Mentions {
+		if m.UserID != msg.Sender && !utils.Contains(users, m.UserID) {
+			users = append(users, m.UserID)
+		}
+	}
+	return users
+}
+
+// Bump the mention counters of users mentioned in msg that weren't already mentioned in
+// previous (the message before an edit). Returns the users whose counter was bumped.
+func recordMentions(msg Message, previous []Mention) []string {
+	var bumped []string
+	for _, userID := range mentionedUsers(msg) {
+		already := false
+		for _, m := range previous {
+			already = already || m.UserID == userID
+		}
+		if already {
+			continue
+		}
+		if err := redisClient.HIncrBy(ctx, mentionUnreadKey(msg.ChatID), userID, 1).Err(); err != nil {
+			log.Println("Failed to count mention:", err)
+		}
+		bumped = append(bumped, userID)
+	}
+	return bumped
+}
+
+// Fill in the user's mention count and mute state for each chat.
+func setChatMentions(chats []Chat, userID string) {
+	now := time.Now()
+	for i := range chats {
+		if n, err := redisClient.HGet(ctx, mentionUnreadKey(chats[i].ChatID), userID).Int(); err == nil {
+			chats[i].MentionUnread = n
+		}
+		if mute := chats[i].muteFor(userID, now); mute != nil {
+			chats[i].Muted, chats[i].MutedUntil = true, mute.Until
+		}
+	}
+}
+
+func sendNotification(msg Message, userID string, mentioned bool) {
+	wsMessage := struct {
+		Type      string `json:"type"`
+		ChatID    string `json:"chat_id"`
+		MessageID string `json:"message_id"`
+		Sender    string `json:"sender"`
+		Preview   string `json:"preview,omitempty"`
+		Mentioned bool   `json:"mentioned,omitempty"`
+	}{
+		Type:      "notification",
+		ChatID:    msg.ChatID,
+		MessageID: msg.MessageID,
+		Sender:    msg.Sender,
+		Preview:   quoteSnippet(msg.Content, msg.Caption),
+		Mentioned: mentioned,
+	}
+	wsNotifyUser(userID, wsMessage)
+}
+
+// Notify the members of a chat of a new message on all their connections. Members who muted
+// the chat are only notified when they are mentioned.
+func notifyMembers(msg Message) {
+	var chat Chat
+	if err := chatsCollection.FindOne(ctx, bson.M{"chat_id": msg.ChatID}).Decode(&chat); err != nil {
+		log.Println("Notification chat lookup error:", msg.ChatID, err)
+		return
+	}
+	mentioned := mentionedUsers(msg)
+	recipients := chat.Members
+	if len(recipients) == 0 {
+		recipients = mentioned
+	}
+
+	now := time.Now()
+	for _, userID := range recipients {
+		if userID == msg.Sender {
+			continue
+		}
+		isMentioned := utils.Contains(mentioned, userID)
+		if chat.muteFor(userID, now) != nil && !isMentioned {
+			continue
+		}
+		sendNotification(msg, userID, isMentioned)
+	}
+}
+
+// Mentions of a message about to be sent or edited in a chat.
+func chatMentions(chatID, content string, entities []Mention) ([]Mention, error) {
+	if len(entities) == 0 && !strings.Contains(content, "@") {
+		return nil, nil
+	}
+	var chat Chat
+	if err := chatsCollection.FindOne(ctx, bson.M{"chat_id": chatID}).Decode(&chat); err != nil {
+		return nil, err
+	}
+	return parseMentions(chat, content, entities)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"nwr/utils"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Muting a chat silences its notifications for one user; see notifyMembers. Mentions still
+// get through.
+
+const maxMuteDuration = 365 * 24 * time.Hour
+
+type Mute struct {
+	UserID string     `json:"user_id" bson:"user_id"`
+	Until  *time.Time `json:"until,omitempty" bson:"until,omitempty"` // Nil mutes until unmuted.
+}
+
+// The user's mute on a chat, if it is still in effect.
+func (c Chat) muteFor(userID string, now time.Time) *Mute {
+	for i, m := range c.Mutes {
+		if m.UserID == userID && (m.Until == nil || now.Before(*m.Until)) {
+			return &c.Mutes[i]
+		}
+	}
+	return nil
+}
+
+// --- Handlers ---
+
+// Mute a chat for duration seconds, or until unmuted when duration is 0.
+func muteChatHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Duration int64 `json:"duration"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request data", http.StatusBadRequest)
+		return
+	}
+	if req.Duration < 0 || time.Duration(req.Duration)*time.Second > maxMuteDuration {
+		http.Error(w, "duration must be positive and at most a year", http.StatusBadRequest)
+		return
+	}
+
+	chat, err := getMemberChat(ps.ByName("chatid"), claims.UserID)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch chat", http.StatusInternalServerError)
+		return
+	}
+
+	mute := Mute{UserID: claims.UserID}
+	if req.Duration > 0 {
+		until := time.Now().Add(time.Duration(req.Duration) * time.Second)
+		mute.Until = &until
+	}
+
+	// Replace the user's previous mute in a single update.
+	update := []bson.M{{"$set": bson.M{"mutes": bson.M{"$concatArrays": []interface{}{
+		bson.M{"$filter": bson.M{
+			"input": bson.M{"$ifNull": []interface{}{"$mutes", bson.A{}}},
+			"cond":  bson.M{"$ne": []interface{}{"$$this.user_id", claims.UserID}},
+		}},
+		bson.A{mute},
+	}}}}}
+	if _, err := chatsCollection.UpdateOne(ctx, bson.M{"chat_id": chat.ChatID}, update); err != nil {
+		http.Error(w, "Failed to mute chat", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bson.M{"chat_id": chat.ChatID, "muted": true, "muted_until": mute.Until})
+}
+
+// Unmute a chat.
+func unmuteChatHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	chat, err := getMemberChat(ps.ByName("chatid"), claims.UserID)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch chat", http.StatusInternalServerError)
+		return
+	}
+
+	update := bson.M{"$pull": bson.M{"mutes": bson.M{"user_id": claims.UserID}}}
+	if _, err := chatsCollection.UpdateOne(ctx, bson.M{"chat_id": chat.ChatID}, update); err != nil {
+		http.Error(w, "Failed to unmute chat", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bson.M{"chat_id": chat.ChatID, "muted": false})
+}
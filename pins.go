@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"nwr/utils"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var maxPinsPerChat = int(utils.EnvInt64("MAX_PINS_PER_CHAT", 3))
+
+type Pin struct {
+	MessageID string     `json:"message_id" bson:"message_id"`
+	PinnedBy  string     `json:"pinned_by" bson:"pinned_by"`
+	PinnedAt  time.Time  `json:"pinnedat" bson:"pinnedat"`
+	ExpiresAt *time.Time `json:"expiresat,omitempty" bson:"expiresat,omitempty"`
+}
+
+func (p Pin) expired(now time.Time) bool {
+	return p.ExpiresAt != nil && !p.ExpiresAt.After(now)
+}
+
+// Pins that have not expired yet.
+func activePins(pins []Pin) []Pin {
+	now := time.Now()
+	active := []Pin{}
+	for _, p := range pins {
+		if !p.expired(now) {
+			active = append(active, p)
+		}
+	}
+	return active
+}
+
+// Admins may pin in group chats; in one-to-one chats both members may.
+func canPin(chat Chat, userID string) bool {
+	if len(chat.Members) <= 2 {
+		return true
+	}
+	return utils.Contains(chat.Admins, userID)
+}
+
+// Unpin a message from its chat, e.g. because it was deleted.
+func removePin(chatID, messageID string) {
+	_, err := chatsCollection.UpdateOne(ctx, bson.M{"chat_id": chatID},
+		bson.M{"$pull": bson.M{"pins": bson.M{"message_id": messageID}}})
+	if err != nil {
+		log.Println("Failed to remove pin:", messageID, err)
+	}
+}
+
+func broadcastPin(chatID, action string, pin Pin) {
+	wsMessage := struct {
+		Type   string `json:"type"`
+		ChatID string `json:"chat_id"`
+		Pin    Pin    `json:"pin"`
+	}{
+		Type:   action,
+		ChatID: chatID,
+		Pin:    pin,
+	}
+	wsBroadcast(chatID, wsMessage)
+}
+
+// --- Handlers ---
+
+// List a chat's pinned messages, most recently pinned first.
+func pinsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	chat, err := getMemberChat(ps.ByName("chatid"), claims.UserID)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch chat", http.StatusInternalServerError)
+		return
+	}
+
+	type pinnedMessage struct {
+		Pin     Pin     `json:"pin"`
+		Message Message `json:"message"`
+	}
+	pinned := []pinnedMessage{}
+	pins := activePins(chat.Pins)
+	for i := len(pins) - 1; i >= 0; i-- {
+		msg, err := getMessage(chat.ChatID, pins[i].MessageID)
+		if err != nil {
+			continue
+		}
+		msg.ReactionSummary = summarizeReactions(msg.Reactions, claims.UserID)
+		pinned = append(pinned, pinnedMessage{Pin: pins[i], Message: msg})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pinned)
+}
+
+// Pin a message, optionally until expires_in seconds from now.
+func pinMessageHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		MessageID string `json:"message_id"`
+		ExpiresIn int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MessageID == "" {
+		http.Error(w, "Invalid request data", http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresIn < 0 {
+		http.Error(w, "expires_in must be positive", http.StatusBadRequest)
+		return
+	}
+
+	chat, err := getMemberChat(ps.ByName("chatid"), claims.UserID)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch chat", http.StatusInternalServerError)
+		return
+	}
+	if !canPin(chat, claims.UserID) {
+		http.Error(w, "Only admins can pin messages", http.StatusForbidden)
+		return
+	}
+
+	if _, err := getMessage(chat.ChatID, req.MessageID); err == mongo.ErrNoDocuments {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch message", http.StatusInternalServerError)
+		return
+	}
+
+	// Stored dates keep milliseconds only; match what will be read back.
+	pin := Pin{MessageID: req.MessageID, PinnedBy: claims.UserID, PinnedAt: time.Now().Truncate(time.Millisecond)}
+	if req.ExpiresIn > 0 {
+		expiresAt := pin.PinnedAt.Add(time.Duration(req.ExpiresIn) * time.Second)
+		pin.ExpiresAt = &expiresAt
+	}
+
+	// Drop expired pins, then add the new one if the message isn't pinned and there's
+	// room, all in one update so concurrent pins can't exceed the limit.
+	update := []bson.M{
+		{"$set": bson.M{"pins": bson.M{"$filter": bson.M{
+			"input": bson.M{"$ifNull": bson.A{"$pins", bson.A{}}},
+			"cond": bson.M{"$or": bson.A{
+				bson.M{"$eq": bson.A{bson.M{"$ifNull": bson.A{"$$this.expiresat", nil}}, nil}},
+				bson.M{"$gt": bson.A{"$$this.expiresat", pin.PinnedAt}},
+			}},
+		}}}},
+		{"$set": bson.M{"pins": bson.M{"$cond": bson.A{
+			bson.M{"$and": bson.A{
+				bson.M{"$lt": bson.A{bson.M{"$size": "$pins"}, maxPinsPerChat}},
+				bson.M{"$not": bson.A{bson.M{"$in": bson.A{pin.MessageID, "$pins.message_id"}}}},
+			}},
+			bson.M{"$concatArrays": bson.A{"$pins", bson.A{bson.M{"$literal": pin}}}},
+			"$pins",
+		}}}},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	if err := chatsCollection.FindOneAndUpdate(ctx, bson.M{"chat_id": chat.ChatID}, update, opts).Decode(&chat); err != nil {
+		http.Error(w, "Failed to pin message", http.StatusInternalServerError)
+		return
+	}
+	pinned := false
+	for _, p := range chat.Pins {
+		if p.MessageID == pin.MessageID {
+			if p.PinnedBy != pin.PinnedBy || !p.PinnedAt.Equal(pin.PinnedAt) {
+				http.Error(w, "Message is already pinned", http.StatusConflict)
+				return
+			}
+			pinned = true
+		}
+	}
+	if !pinned {
+		http.Error(w, "Pin limit reached", http.StatusConflict)
+		return
+	}
+
+	broadcastPin(chat.ChatID, "pin", pin)
+	saveSystemMessage(chat.ChatID, SystemEvent{Action: "pin", Actor: claims.UserID, MessageID: pin.MessageID})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pin)
+}
+
+// Unpin a message.
+func unpinMessageHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Invalid Method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	chat, err := getMemberChat(ps.ByName("chatid"), claims.UserID)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch chat", http.StatusInternalServerError)
+		return
+	}
+	if !canPin(chat, claims.UserID) {
+		http.Error(w, "Only admins can unpin messages", http.StatusForbidden)
+		return
+	}
+
+	messageID := ps.ByName("messageid")
+	var pin *Pin
+	for _, p := range activePins(chat.Pins) {
+		if p.MessageID == messageID {
+			pin = &p
+			break
+		}
+	}
+	if pin == nil {
+		http.Error(w, "Message is not pinned", http.StatusNotFound)
+		return
+	}
+
+	removePin(chat.ChatID, messageID)
+	broadcastPin(chat.ChatID, "unpin", *pin)
+	saveSystemMessage(chat.ChatID, SystemEvent{Action: "unpin", Actor: claims.UserID, MessageID: messageID})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bson.M{"chat_id": chat.ChatID, "message_id": messageID, "pinned": false})
+}
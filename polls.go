@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"nwr/utils"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const MessageTypePoll = "poll"
+
+const (
+	maxPollQuestion = 300 // Characters.
+	maxPollOption   = 100
+	minPollOptions  = 2
+	maxPollOptions  = 12
+	maxPollDuration = 30 * 24 * time.Hour
+)
+
+// A poll attached to a message. Raw votes are stored; clients get them tallied per option,
+// without voter names when the poll is anonymous.
+type Poll struct {
+	Question       string       `json:"question" bson:"question"`
+	Options        []PollOption `json:"options" bson:"options"`
+	MultipleChoice bool         `json:"multiple_choice" bson:"multiple_choice"`
+	Anonymous      bool         `json:"anonymous" bson:"anonymous"`
+	ClosesAt       *time.Time   `json:"closesat,omitempty" bson:"closesat,omitempty"`
+	ClosedAt       *time.Time   `json:"closedat,omitempty" bson:"closedat,omitempty"`
+	Votes          []PollVote   `json:"-" bson:"votes,omitempty"`
+
+	Closed      bool     `json:"closed" bson:"-"`
+	TotalVoters int      `json:"total_voters" bson:"-"`
+	MyVotes     []string `json:"my_votes,omitempty" bson:"-"`
+}
+
+type PollOption struct {
+	ID     string   `json:"id" bson:"id"`
+	Text   string   `json:"text" bson:"text"`
+	Votes  int      `json:"votes" bson:"-"`
+	Voters []string `json:"voters,omitempty" bson:"-"` // Left empty for anonymous polls.
+}
+
+type PollVote struct {
+	UserID    string    `json:"user_id" bson:"user_id"`
+	OptionIDs []string  `json:"option_ids" bson:"option_ids"`
+	VotedAt   time.Time `json:"votedat" bson:"votedat"`
+}
+
+func (p *Poll) closed(now time.Time) bool {
+	return p.ClosedAt != nil || (p.ClosesAt != nil && !now.Before(*p.ClosesAt))
+}
+
+// Fill in the per-option tallies as seen by userID; pass "" for a view shared by everyone.
+func (p *Poll) tally(userID string) {
+	p.Closed = p.closed(time.Now())
+	p.TotalVoters = len(p.Votes)
+	p.MyVotes = nil
+	for i := range p.Options {
+		p.Options[i].Votes, p.Options[i].Voters = 0, nil
+	}
+	for _, v := range p.Votes {
+		if v.UserID == userID {
+			p.MyVotes = v.OptionIDs
+		}
+		for i := range p.Options {
+			if !utils.Contains(v.OptionIDs, p.Options[i].ID) {
+				continue
+			}
+			p.Options[i].Votes++
+			if !p.Anonymous {
+				p.Options[i].Voters = append(p.Options[i].Voters, v.UserID)
+			}
+		}
+	}
+}
+
+// Filter matching a poll message that still accepts votes.
+func openPollFilter(messageID string, now time.Time) bson.M {
+	return bson.M{
+		"message_id":    messageID,
+		"deleted":       false,
+		"poll.closedat": bson.M{"$exists": false},
+		"$or": []bson.M{
+			{"poll.closesat": bson.M{"$exists": false}},
+			{"poll.closesat": bson.M{"$gt": now}},
+		},
+	}
+}
+
+func broadcastPoll(msg Message) {
+	msg.Poll.tally("")
+	wsMessage := struct {
+		Type      string `json:"type"`
+		ChatID    string `json:"chat_id"`
+		MessageID string `json:"message_id"`
+		Poll      *Poll  `json:"poll"`
+	}{
+		Type:      "poll",
+		ChatID:    msg.ChatID,
+		MessageID: msg.MessageID,
+		Poll:      msg.Poll,
+	}
+	wsBroadcast(msg.ChatID, wsMessage)
+}
+
+// Close polls whose close time has passed and push their final tallies.
+func closeDuePolls() {
+	now := time.Now()
+	for {
+		var msg Message
+		err := messagesCollection.FindOneAndUpdate(ctx,
+			bson.M{"poll.closesat": bson.M{"$lte": now}, "poll.closedat": bson.M{"$exists": false}},
+			[]bson.M{{"$set": bson.M{"poll.closedat": "$poll.closesat"}}},
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&msg)
+		if err == mongo.ErrNoDocuments {
+			return
+		} else if err != nil {
+			log.Println("Poll close error:", err)
+			return
+		}
+		if !msg.Deleted && msg.Poll != nil {
+			broadcastPoll(msg)
+		}
+	}
+}
+
+// Fetch a poll message from a chat the user belongs to.
+func getMemberPoll(w http.ResponseWriter, messageID, userID string) (Message, bool) {
+	msg, err := getMemberMessage(messageID, userID)
+	if err == mongo.ErrNoDocuments || (err == nil && msg.Poll == nil) {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return msg, false
+	} else if err != nil {
+		http.Error(w, "Failed to fetch poll", http.StatusInternalServerError)
+		return msg, false
+	}
+	return msg, true
+}
+
+// --- Handlers ---
+
+// Create a poll in a chat. The poll closes closes_in seconds from now when given.
+func createPollHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Question       string   `json:"question"`
+		Options        []string `json:"options"`
+		MultipleChoice bool     `json:"multiple_choice"`
+		Anonymous      bool     `json:"anonymous"`
+		ClosesIn       int64    `json:"closes_in"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request data", http.StatusBadRequest)
+		return
+	}
+
+	req.Question, err = sanitizeText(strings.TrimSpace(req.Question), maxPollQuestion)
+	if err != nil {
+		http.Error(w, "question: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Question == "" {
+		http.Error(w, "question is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Options) < minPollOptions || len(req.Options) > maxPollOptions {
+		http.Error(w, "A poll needs between "+strconv.Itoa(minPollOptions)+" and "+strconv.Itoa(maxPollOptions)+" options", http.StatusBadRequest)
+		return
+	}
+	var seen []string
+	pollOptions := make([]PollOption, 0, len(req.Options))
+	for i, text := range req.Options {
+		text, err := sanitizeText(strings.TrimSpace(text), maxPollOption)
+		if err != nil {
+			http.Error(w, "options: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if text == "" {
+			http.Error(w, "Options must be non-empty", http.StatusBadRequest)
+			return
+		}
+		if utils.Contains(seen, strings.ToLower(text)) {
+			http.Error(w, "Options must be unique", http.StatusBadRequest)
+			return
+		}
+		seen = append(seen, strings.ToLower(text))
+		pollOptions = append(pollOptions, PollOption{ID: strconv.Itoa(i), Text: text})
+	}
+	if req.ClosesIn < 0 || time.Duration(req.ClosesIn)*time.Second > maxPollDuration {
+		http.Error(w, "closes_in must be positive and at most 30 days", http.StatusBadRequest)
+		return
+	}
+
+	chat, err := getMemberChat(ps.ByName("chatid"), claims.UserID)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch chat", http.StatusInternalServerError)
+		return
+	}
+
+	poll := &Poll{
+		Question:       req.Question,
+		Options:        pollOptions,
+		MultipleChoice: req.MultipleChoice,
+		Anonymous:      req.Anonymous,
+	}
+	msg := Message{
+		MessageID: generateMessageID(),
+		ChatID:    chat.ChatID,
+		Type:      MessageTypePoll,
+		Sender:    claims.UserID,
+		Content:   req.Question, // Keeps polls searchable and quotable.
+		Poll:      poll,
+		CreatedAt: time.Now(),
+	}
+	if req.ClosesIn > 0 {
+		closesAt := msg.CreatedAt.Add(time.Duration(req.ClosesIn) * time.Second)
+		poll.ClosesAt = &closesAt
+	}
+	poll.tally(claims.UserID)
+
+	if err := deliverMessage(&msg); err != nil {
+		http.Error(w, "Failed to save poll", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msg)
+}
+
+// Vote in a poll, replacing the user's previous vote. An empty option_ids retracts it.
+func votePollHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		OptionIDs []string `json:"option_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request data", http.StatusBadRequest)
+		return
+	}
+
+	msg, ok := getMemberPoll(w, ps.ByName("id"), claims.UserID)
+	if !ok {
+		return
+	}
+
+	var choices []string
+	for _, id := range req.OptionIDs {
+		valid := false
+		for _, o := range msg.Poll.Options {
+			valid = valid || o.ID == id
+		}
+		if !valid {
+			http.Error(w, "Unknown option: "+id, http.StatusBadRequest)
+			return
+		}
+		if !utils.Contains(choices, id) {
+			choices = append(choices, id)
+		}
+	}
+	if len(choices) > 1 && !msg.Poll.MultipleChoice {
+		http.Error(w, "This poll allows a single choice", http.StatusBadRequest)
+		return
+	}
+
+	// Replace the user's previous vote in a single update.
+	votes := []interface{}{bson.M{"$filter": bson.M{
+		"input": bson.M{"$ifNull": []interface{}{"$poll.votes", bson.A{}}},
+		"cond":  bson.M{"$ne": []interface{}{"$$this.user_id", claims.UserID}},
+	}}}
+	if len(choices) > 0 {
+		votes = append(votes, bson.A{PollVote{UserID: claims.UserID, OptionIDs: choices, VotedAt: time.Now()}})
+	}
+	update := []bson.M{{"$set": bson.M{"poll.votes": bson.M{"$concatArrays": votes}}}}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = messagesCollection.FindOneAndUpdate(ctx, openPollFilter(msg.MessageID, time.Now()), update, opts).Decode(&msg)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Poll is closed", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to save vote", http.StatusInternalServerError)
+		return
+	}
+	broadcastPoll(msg)
+
+	msg.Poll.tally(claims.UserID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msg.Poll)
+}
+
+// Close a poll before its close time. Only its creator may do so.
+func closePollHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	msg, ok := getMemberPoll(w, ps.ByName("id"), claims.UserID)
+	if !ok {
+		return
+	}
+	if msg.Sender != claims.UserID {
+		http.Error(w, "Only the poll's creator can close it", http.StatusForbidden)
+		return
+	}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	update := bson.M{"$set": bson.M{"poll.closedat": time.Now()}}
+	err = messagesCollection.FindOneAndUpdate(ctx, openPollFilter(msg.MessageID, time.Now()), update, opts).Decode(&msg)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Poll is already closed", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to close poll", http.StatusInternalServerError)
+		return
+	}
+	broadcastPoll(msg)
+
+	msg.Poll.tally(claims.UserID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msg.Poll)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"nwr/utils"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// How many different reactions a user may leave on one message. With the default of 1,
+// reacting again replaces the previous reaction.
+var maxReactionsPerUser = int(utils.EnvInt64("MAX_REACTIONS_PER_USER", 1))
+
+const maxEmojiRunes = 10 // Long enough for ZWJ sequences and skin tones.
+
+type Reaction struct {
+	UserID    string    `json:"user_id" bson:"user_id"`
+	Emoji     string    `json:"emoji" bson:"emoji"`
+	ReactedAt time.Time `json:"reactedat" bson:"reactedat"`
+}
+
+// Reactions of one kind on a message, as returned to clients.
+type ReactionCount struct {
+	Emoji       string `json:"emoji"`
+	Count       int    `json:"count"`
+	ReactedByMe bool   `json:"reacted_by_me,omitempty"`
+}
+
+// Aggregate reactions per emoji, in the order each emoji was first used.
+func summarizeReactions(reactions []Reaction, userID string) []ReactionCount {
+	var summary []ReactionCount
+	index := make(map[string]int)
+	for _, r := range reactions {
+		i, ok := index[r.Emoji]
+		if !ok {
+			i = len(summary)
+			index[r.Emoji] = i
+			summary = append(summary, ReactionCount{Emoji: r.Emoji})
+		}
+		summary[i].Count++
+		if r.UserID == userID {
+			summary[i].ReactedByMe = true
+		}
+	}
+	return summary
+}
+
+// The Extended_Pictographic property of Unicode's emoji data, which the unicode package
+// doesn't have.
+var extendedPictographic = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x00A9, Hi: 0x00A9, Stride: 1},
+		{Lo: 0x00AE, Hi: 0x00AE, Stride: 1},
+		{Lo: 0x203C, Hi: 0x203C, Stride: 1},
+		{Lo: 0x2049, Hi: 0x2049, Stride: 1},
+		{Lo: 0x2122, Hi: 0x2122, Stride: 1},
+		{Lo: 0x2139, Hi: 0x2139, Stride: 1},
+		{Lo: 0x2194, Hi: 0x2199, Stride: 1},
+		{Lo: 0x21A9, Hi: 0x21AA, Stride: 1},
+		{Lo: 0x231A, Hi: 0x231B, Stride: 1},
+		{Lo: 0x2328, Hi: 0x2328, Stride: 1},
+		{Lo: 0x2388, Hi: 0x2388, Stride: 1},
+		{Lo: 0x23CF, Hi: 0x23CF, Stride: 1},
+		{Lo: 0x23E9, Hi: 0x23F3, Stride: 1},
+		{Lo: 0x23F8, Hi: 0x23FA, Stride: 1},
+		{Lo: 0x24C2, Hi: 0x24C2, Stride: 1},
+		{Lo: 0x25AA, Hi: 0x25AB, Stride: 1},
+		{Lo: 0x25B6, Hi: 0x25B6, Stride: 1},
+		{Lo: 0x25C0, Hi: 0x25C0, Stride: 1},
+		{Lo: 0x25FB, Hi: 0x25FE, Stride: 1},
+		{Lo: 0x2600, Hi: 0x2605, Stride: 1},
+		{Lo: 0x2607, Hi: 0x2612, Stride: 1},
+		{Lo: 0x2614, Hi: 0x2685, Stride: 1},
+		{Lo: 0x2690, Hi: 0x2705, Stride: 1},
+		{Lo: 0x2708, Hi: 0x2712, Stride: 1},
+		{Lo: 0x2714, Hi: 0x2714, Stride: 1},
+		{Lo: 0x2716, Hi: 0x2716, Stride: 1},
+		{Lo: 0x271D, Hi: 0x271D, Stride: 1},
+		{Lo: 0x2721, Hi: 0x2721, Stride: 1},
+		{Lo: 0x2728, Hi: 0x2728, Stride: 1},
+		{Lo: 0x2733, Hi: 0x2734, Stride: 1},
+		{Lo: 0x2744, Hi: 0x2744, Stride: 1},
+		{Lo: 0x2747, Hi: 0x2747, Stride: 1},
+		{Lo: 0x274C, Hi: 0x274C, Stride: 1},
+		{Lo: 0x274E, Hi: 0x274E, Stride: 1},
+		{Lo: 0x2753, Hi: 0x2755, Stride: 1},
+		{Lo: 0x2757, Hi: 0x2757, Stride: 1},
+		{Lo: 0x2763, Hi: 0x2767, Stride: 1},
+		{Lo: 0x2795, Hi: 0x2797, Stride: 1},
+		{Lo: 0x27A1, Hi: 0x27A1, Stride: 1},
+		{Lo: 0x27B0, Hi: 0x27B0, Stride: 1},
+		{Lo: 0x27BF, Hi: 0x27BF, Stride: 1},
+		{Lo: 0x2934, Hi: 0x2935, Stride: 1},
+		{Lo: 0x2B05, Hi: 0x2B07, Stride: 1},
+		{Lo: 0x2B1B, Hi: 0x2B1C, Stride: 1},
+		{Lo: 0x2B50, Hi: 0x2B50, Stride: 1},
+		{Lo: 0x2B55, Hi: 0x2B55, Stride: 1},
+		{Lo: 0x3030, Hi: 0x3030, Stride: 1},
+		{Lo: 0x303D, Hi: 0x303D, Stride: 1},
+		{Lo: 0x3297, Hi: 0x3297, Stride: 1},
+		{Lo: 0x3299, Hi: 0x3299, Stride: 1},
+	},
+	R32: []unicode.Range32{
+		{Lo: 0x1F000, Hi: 0x1F0FF, Stride: 1},
+		{Lo: 0x1F10D, Hi: 0x1F10F, Stride: 1},
+		{Lo: 0x1F12F, Hi: 0x1F12F, Stride: 1},
+		{Lo: 0x1F16C, Hi: 0x1F171, Stride: 1},
+		{Lo: 0x1F17E, Hi: 0x1F17F, Stride: 1},
+		{Lo: 0x1F18E, Hi: 0x1F18E, Stride: 1},
+		{Lo: 0x1F191, Hi: 0x1F19A, Stride: 1},
+		{Lo: 0x1F1AD, Hi: 0x1F1E5, Stride: 1},
+		{Lo: 0x1F201, Hi: 0x1F20F, Stride: 1},
+		{Lo: 0x1F21A, Hi: 0x1F21A, Stride: 1},
+		{Lo: 0x1F22F, Hi: 0x1F22F, Stride: 1},
+		{Lo: 0x1F232, Hi: 0x1F23A, Stride: 1},
+		{Lo: 0x1F23C, Hi: 0x1F23F, Stride: 1},
+		{Lo: 0x1F249, Hi: 0x1F3FA, Stride: 1},
+		{Lo: 0x1F400, Hi: 0x1F53D, Stride: 1},
+		{Lo: 0x1F546, Hi: 0x1F64F, Stride: 1},
+		{Lo: 0x1F680, Hi: 0x1F6FF, Stride: 1},
+		{Lo: 0x1F774, Hi: 0x1F77F, Stride: 1},
+		{Lo: 0x1F7D5, Hi: 0x1F7FF, Stride: 1},
+		{Lo: 0x1F80C, Hi: 0x1F80F, Stride: 1},
+		{Lo: 0x1F848, Hi: 0x1F84F, Stride: 1},
+		{Lo: 0x1F85A, Hi: 0x1F85F, Stride: 1},
+		{Lo: 0x1F888, Hi: 0x1F88F, Stride: 1},
+		{Lo: 0x1F8AE, Hi: 0x1F8FF, Stride: 1},
+		{Lo: 0x1F90C, Hi: 0x1F93A, Stride: 1},
+		{Lo: 0x1F93C, Hi: 0x1F945, Stride: 1},
+		{Lo: 0x1F947, Hi: 0x1FAFF, Stride: 1},
+		{Lo: 0x1FC00, Hi: 0x1FFFD, Stride: 1},
+	},
+	LatinOffset: 2,
+}
+
+// Whether s is a single emoji: pictographs joined by ZWJs and adorned with variation
+// selectors and skin tones, a flag, or a keycap.
+func validEmoji(s string) bool {
+	if s == "" || !utf8.ValidString(s) || utf8.RuneCountInString(s) > maxEmojiRunes {
+		return false
+	}
+	keycap := strings.HasSuffix(s, "\u20E3")
+	hasEmoji := false
+	for _, r := range s {
+		switch {
+		case unicode.Is(extendedPictographic, r),
+			r >= 0x1F1E6 && r <= 0x1F1FF, // Regional indicators, in pairs for flags.
+			keycap && (r == '#' || r == '*' || (r >= '0' && r <= '9')):
+			hasEmoji = true
+		case r == 0x200D, // Zero width joiner.
+			r == 0xFE0E || r == 0xFE0F,   // Variation selectors.
+			r >= 0x1F3FB && r <= 0x1F3FF, // Skin tones.
+			r >= 0xE0020 && r <= 0xE007F, // Tags, for subdivision flags.
+			r == 0x20E3:                  // Combining keycap.
+		default:
+			return false
+		}
+	}
+	return hasEmoji
+}
+
+// Fetch a live message by ID, checking the user belongs to its chat.
+func getMemberMessage(messageID, userID string) (Message, error) {
+	var msg Message
+	err := messagesCollection.FindOne(ctx, bson.M{"message_id": messageID, "deleted": false}).Decode(&msg)
+	if err != nil {
+		return msg, err
+	}
+	if _, err := getMemberChat(msg.ChatID, userID); err != nil {
+		return msg, err
+	}
+	return msg, nil
+}
+
+func broadcastReactions(msg Message, userID, emoji, action string) {
+	wsMessage := struct {
+		Type      string          `json:"type"`
+		ChatID    string          `json:"chat_id"`
+		MessageID string          `json:"message_id"`
+		UserID    string          `json:"user_id"`
+		Emoji     string          `json:"emoji,omitempty"`
+		Action    string          `json:"action"`
+		Reactions []ReactionCount `json:"reactions"`
+	}{
+		Type:      "reaction",
+		ChatID:    msg.ChatID,
+		MessageID: msg.MessageID,
+		UserID:    userID,
+		Emoji:     emoji,
+		Action:    action,
+		Reactions: summarizeReactions(msg.Reactions, ""),
+	}
+	wsBroadcast(msg.ChatID, wsMessage)
+}
+
+// --- Handlers ---
+
+// React to a message. Reactions don't touch the chat preview.
+func putReactionHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Emoji string `json:"emoji"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request data", http.StatusBadRequest)
+		return
+	}
+	req.Emoji = strings.TrimSpace(req.Emoji)
+	if !validEmoji(req.Emoji) {
+		http.Error(w, "Invalid emoji", http.StatusBadRequest)
+		return
+	}
+
+	msg, err := getMemberMessage(ps.ByName("id"), claims.UserID)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch message", http.StatusInternalServerError)
+		return
+	}
+
+	reaction := Reaction{UserID: claims.UserID, Emoji: req.Emoji, ReactedAt: time.Now()}
+	filter := bson.M{"message_id": msg.MessageID}
+	var update interface{}
+	if maxReactionsPerUser <= 1 {
+		// Replace the user's previous reaction in a single update.
+		update = []bson.M{{"$set": bson.M{"reactions": bson.M{"$concatArrays": []interface{}{
+			bson.M{"$filter": bson.M{
+				"input": bson.M{"$ifNull": []interface{}{"$reactions", bson.A{}}},
+				"cond":  bson.M{"$ne": []interface{}{"$$this.user_id", claims.UserID}},
+			}},
+			bson.A{bson.M{"$literal": reaction}}, // Stored as given, even if it holds "$" strings.
+		}}}}}
+	} else {
+		for _, existing := range msg.Reactions {
+			if existing.UserID == claims.UserID && existing.Emoji == req.Emoji {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		// The limit is checked by the update itself, so concurrent reactions can't exceed it.
+		filter["reactions"] = bson.M{"$not": bson.M{"$elemMatch": bson.M{"user_id": claims.UserID, "emoji": req.Emoji}}}
+		filter["$expr"] = bson.M{"$lt": []interface{}{
+			bson.M{"$size": bson.M{"$filter": bson.M{
+				"input": bson.M{"$ifNull": []interface{}{"$reactions", bson.A{}}},
+				"cond":  bson.M{"$eq": []interface{}{"$$this.user_id", claims.UserID}},
+			}}},
+			maxReactionsPerUser,
+		}}
+		update = bson.M{"$push": bson.M{"reactions": reaction}}
+	}
+
+	res, err := messagesCollection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		http.Error(w, "Failed to save reaction", http.StatusInternalServerError)
+		return
+	}
+	if res.MatchedCount == 0 { // At the limit, or the same reaction was just added concurrently.
+		http.Error(w, "Reaction limit reached", http.StatusConflict)
+		return
+	}
+
+	if err := messagesCollection.FindOne(ctx, bson.M{"message_id": msg.MessageID}).Decode(&msg); err != nil {
+		http.Error(w, "Failed to fetch message", http.StatusInternalServerError)
+		return
+	}
+	broadcastReactions(msg, claims.UserID, req.Emoji, "add")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summarizeReactions(msg.Reactions, claims.UserID))
+}
+
+// Remove the user's reaction from a message; all of them when no emoji is given.
+func deleteReactionHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Emoji string `json:"emoji"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request data", http.StatusBadRequest)
+			return
+		}
+	}
+
+	msg, err := getMemberMessage(ps.ByName("id"), claims.UserID)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch message", http.StatusInternalServerError)
+		return
+	}
+
+	pull := bson.M{"user_id": claims.UserID}
+	if req.Emoji != "" {
+		pull["emoji"] = strings.TrimSpace(req.Emoji)
+	}
+	update := bson.M{"$pull": bson.M{"reactions": pull}}
+	if _, err := messagesCollection.UpdateOne(ctx, bson.M{"message_id": msg.MessageID}, update); err != nil {
+		http.Error(w, "Failed to remove reaction", http.StatusInternalServerError)
+		return
+	}
+
+	if err := messagesCollection.FindOne(ctx, bson.M{"message_id": msg.MessageID}).Decode(&msg); err != nil {
+		http.Error(w, "Failed to fetch message", http.StatusInternalServerError)
+		return
+	}
+	broadcastReactions(msg, claims.UserID, req.Emoji, "remove")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summarizeReactions(msg.Reactions, claims.UserID))
+}
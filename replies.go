@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const quoteSnippetLength = 100 // Runes of the original kept in a quote.
+
+// A compact copy of the message being replied to, embedded in the reply.
+type Quote struct {
+	MessageID string `json:"message_id" bson:"message_id"`
+	Sender    string `json:"sender" bson:"sender"`
+	Snippet   string `json:"snippet,omitempty" bson:"snippet,omitempty"`
+	Type      string `json:"type,omitempty" bson:"type,omitempty"`
+	Deleted   bool   `json:"deleted,omitempty" bson:"deleted,omitempty"`
+}
+
+func quoteSnippet(content, caption string) string {
+	text := content
+	if text == "" {
+		text = caption
+	}
+	text = strings.Join(strings.Fields(text), " ")
+	if r := []rune(text); len(r) > quoteSnippetLength {
+		return string(r[:quoteSnippetLength]) + "…"
+	}
+	return text
+}
+
+func newQuote(msg Message) *Quote {
+	return &Quote{
+		MessageID: msg.MessageID,
+		Sender:    msg.Sender,
+		Snippet:   quoteSnippet(msg.Content, msg.Caption),
+		Type:      msg.Type,
+	}
+}
+
+// Fetch a live message of a chat, including one still buffered in Redis.
+func getMessage(chatID, messageID string) (Message, error) {
+	var msg Message
+	err := messagesCollection.FindOne(ctx, bson.M{"chat_id": chatID, "message_id": messageID, "deleted": false}).Decode(&msg)
+	if err != mongo.ErrNoDocuments {
+		return msg, err
+	}
+
+	entries, rerr := redisClient.LRange(ctx, "chat:"+chatID+":messages", 0, -1).Result()
+	if rerr != nil {
+		return msg, rerr
+	}
+	for _, mStr := range entries {
+		var m Message
+		if json.Unmarshal([]byte(mStr), &m) == nil && m.MessageID == messageID && !m.Deleted {
+			return m, nil
+		}
+	}
+	return msg, mongo.ErrNoDocuments
+}
+
+// Refresh the quotes of replies to a message after it was edited.
+func refreshQuotes(msg Message) {
+	filter := bson.M{"chat_id": msg.ChatID, "reply_to.message_id": msg.MessageID}
+	update := bson.M{"$set": bson.M{"reply_to.snippet": quoteSnippet(msg.Content, msg.Caption)}}
+	if _, err := messagesCollection.UpdateMany(ctx, filter, update); err != nil {
+		log.Println("Failed to refresh quotes:", msg.MessageID, err)
+	}
+}
+
+// Blank the quotes of replies to a message after it was deleted.
+func markQuotesDeleted(chatID, messageID string) {
+	filter := bson.M{"chat_id": chatID, "reply_to.message_id": messageID}
+	update := bson.M{
+		"$set":   bson.M{"reply_to.deleted": true},
+		"$unset": bson.M{"reply_to.snippet": ""},
+	}
+	if _, err := messagesCollection.UpdateMany(ctx, filter, update); err != nil {
+		log.Println("Failed to update quotes:", messageID, err)
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"nwr/utils"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Rich text: message content may use WhatsApp-style markup (*bold*, _italic_, ~strike~,
+// `code`, ```blocks```, "> " quotes and "- "/"1. " lists). Content is kept as typed; the
+// parser derives Text, the content with markup removed, and entities pointing into it.
+// Links, e-mail addresses and phone numbers are recognized in Text as well. Like mentions,
+// entity offsets and lengths count UTF-16 code units.
+
+const (
+	maxContentLength = 4096 // Characters.
+	maxCaptionLength = 1024
+)
+
+const (
+	EntityBold     = "bold"
+	EntityItalic   = "italic"
+	EntityStrike   = "strike"
+	EntityCode     = "code"
+	EntityPre      = "pre"
+	EntityQuote    = "quote"
+	EntityBullet   = "bullet"
+	EntityNumbered = "numbered"
+	EntityURL      = "url"
+	EntityEmail    = "email"
+	EntityPhone    = "phone"
+	EntityMention  = "mention"
+)
+
+type TextEntity struct {
+	Type    string `json:"type" bson:"type"`
+	Offset  int    `json:"offset" bson:"offset"`
+	Length  int    `json:"length" bson:"length"`
+	URL     string `json:"url,omitempty" bson:"url,omitempty"`         // Target of links, e-mail addresses and phone numbers.
+	UserID  string `json:"user_id,omitempty" bson:"user_id,omitempty"` // Mentioned user.
+	Ordinal int    `json:"ordinal,omitempty" bson:"ordinal,omitempty"` // Number of a numbered list item.
+}
+
+var (
+	errTextTooLong      = errors.New("text is too long")
+	errTextInvalidUTF8  = errors.New("text is not valid UTF-8")
+	errTextControlChars = errors.New("text contains control characters")
+)
+
+var inlineMarkers = map[byte]string{'*': EntityBold, '_': EntityItalic, '~': EntityStrike, '`': EntityCode}
+
+var (
+	numberedItemPattern = regexp.MustCompile(`^(\d{1,3})\. `)
+	linkPattern         = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"]+`)
+	emailPattern        = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`)
+	phonePattern        = regexp.MustCompile(`\+\d[\d ().-]{5,18}\d|\(?\b\d{3}\)?[ .-]\d{3}[ .-]\d{4}\b`)
+)
+
+// Normalize line breaks and check text against a length limit and for control characters.
+// Tabs and newlines are allowed, as are zero-width joiners and other format characters
+// emoji need, but not the bidirectional overrides that can disguise text.
+func sanitizeText(s string, limit int) (string, error) {
+	if !utf8.ValidString(s) {
+		return "", errTextInvalidUTF8
+	}
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	if utf8.RuneCountInString(s) > limit {
+		return "", errTextTooLong
+	}
+	for _, r := range s {
+		if (unicode.IsControl(r) && r != '\n' && r != '\t') || (r >= 0x202A && r <= 0x202E) || (r >= 0x2066 && r <= 0x2069) {
+			return "", errTextControlChars
+		}
+	}
+	return s, nil
+}
+
+// Entity with byte offsets into the parser's output.
+type rawEntity struct {
+	TextEntity
+	start, end int
+}
+
+type markupParser struct {
+	in       string
+	out      strings.Builder
+	pos      []int // Output offset of every input byte, plus one past the end.
+	entities []rawEntity
+}
+
+// Copy in[from:to] to the output.
+func (p *markupParser) emit(from, to int) {
+	for i := from; i < to; i++ {
+		p.pos[i] = p.out.Len()
+		p.out.WriteByte(p.in[i])
+	}
+}
+
+// Drop in[from:to], a markup marker.
+func (p *markupParser) skip(from, to int) {
+	for i := from; i < to; i++ {
+		p.pos[i] = p.out.Len()
+	}
+}
+
+func (p *markupParser) add(e TextEntity, start int) {
+	if p.out.Len() > start {
+		p.entities = append(p.entities, rawEntity{TextEntity: e, start: start, end: p.out.Len()})
+	}
+}
+
+func (p *markupParser) parse() {
+	for i := 0; i < len(p.in); {
+		eol := strings.IndexByte(p.in[i:], '\n')
+		if eol < 0 {
+			eol = len(p.in)
+		} else {
+			eol += i
+		}
+
+		// A fenced block runs to the closing fence, across lines.
+		if strings.HasPrefix(p.in[i:], "```") {
+			if end := strings.Index(p.in[i+3:], "```"); end > 0 {
+				end += i + 3
+				// Line breaks just inside the fences belong to the fences.
+				from, to := i+3, end
+				if p.in[from] == '\n' {
+					from++
+				}
+				if to > from && p.in[to-1] == '\n' {
+					to--
+				}
+				p.skip(i, from)
+				start := p.out.Len()
+				p.emit(from, to)
+				p.add(TextEntity{Type: EntityPre}, start)
+				p.skip(to, end+3)
+				i = end + 3
+				continue
+			}
+		}
+
+		line := p.in[i:eol]
+		var block TextEntity
+		prefix := 0
+		switch {
+		case strings.HasPrefix(line, "> "):
+			block, prefix = TextEntity{Type: EntityQuote}, 2
+		case strings.HasPrefix(line, "* "), strings.HasPrefix(line, "- "):
+			block, prefix = TextEntity{Type: EntityBullet}, 2
+		default:
+			if m := numberedItemPattern.FindStringSubmatch(line); m != nil {
+				n, _ := strconv.Atoi(m[1])
+				block, prefix = TextEntity{Type: EntityNumbered, Ordinal: n}, len(m[0])
+			}
+		}
+
+		p.skip(i, i+prefix)
+		start := p.out.Len()
+		// Consecutive quoted lines make one quote: find the previous line's, before this
+		// line's inline entities follow it.
+		quote := -1
+		if block.Type == EntityQuote {
+			for j := len(p.entities) - 1; j >= 0; j-- {
+				if p.entities[j].Type == EntityQuote && p.entities[j].end == start-1 {
+					quote = j
+					break
+				}
+			}
+		}
+		p.inline(i+prefix, eol)
+		if quote >= 0 {
+			p.entities[quote].end = p.out.Len()
+		} else if block.Type != "" {
+			p.add(block, start)
+		}
+
+		if eol < len(p.in) {
+			p.emit(eol, eol+1)
+		}
+		i = eol + 1
+	}
+	p.pos[len(p.in)] = p.out.Len()
+}
+
+// Parse the inline markup of in[from:to], which doesn't span lines.
+func (p *markupParser) inline(from, to int) {
+	for i := from; i < to; {
+		if strings.HasPrefix(p.in[i:to], "```") {
+			if end := strings.Index(p.in[i+3:to], "```"); end > 0 {
+				end += i + 3
+				p.skip(i, i+3)
+				start := p.out.Len()
+				p.emit(i+3, end)
+				p.add(TextEntity{Type: EntityCode}, start)
+				p.skip(end, end+3)
+				i = end + 3
+				continue
+			}
+		}
+
+		if typ, ok := inlineMarkers[p.in[i]]; ok && p.canOpen(i, from, to) {
+			if end := p.findClose(i, to); end > 0 {
+				p.skip(i, i+1)
+				start := p.out.Len()
+				if typ == EntityCode {
+					p.emit(i+1, end) // No markup inside code.
+				} else {
+					p.inline(i+1, end)
+				}
+				p.add(TextEntity{Type: typ}, start)
+				p.skip(end, end+1)
+				i = end + 1
+				continue
+			}
+		}
+
+		p.emit(i, i+1)
+		i++
+	}
+}
+
+// A marker opens a span at the start of a word and when followed by text.
+func (p *markupParser) canOpen(i, from, to int) bool {
+	if i+1 >= to || unicode.IsSpace(rune(p.in[i+1])) || p.in[i+1] == p.in[i] {
+		return false
+	}
+	if i == from {
+		return true
+	}
+	r, _ := utf8.DecodeLastRuneInString(p.in[from:i])
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// Find the marker closing the span opened at i: preceded by text and at the end of a word.
+func (p *markupParser) findClose(i, to int) int {
+	for j := i + 2; j < to; j++ {
+		if p.in[j] != p.in[i] {
+			continue
+		}
+		if p.in[i] == '`' {
+			return j
+		}
+		if unicode.IsSpace(rune(p.in[j-1])) {
+			continue
+		}
+		if j+1 < to {
+			if r, _ := utf8.DecodeRuneInString(p.in[j+1 : to]); unicode.IsLetter(r) || unicode.IsDigit(r) {
+				continue
+			}
+		}
+		return j
+	}
+	return -1
+}
+
+// Recognize links, e-mail addresses and phone numbers outside code.
+func (p *markupParser) autolink() {
+	text := p.out.String()
+	var taken []rawEntity
+	for _, e := range p.entities {
+		if e.Type == EntityCode || e.Type == EntityPre {
+			taken = append(taken, e)
+		}
+	}
+	free := func(start, end int) bool {
+		for _, e := range taken {
+			if start < e.end && e.start < end {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, loc := range linkPattern.FindAllStringIndex(text, -1) {
+		start, end := loc[0], loc[0]+len(trimURL(text[loc[0]:loc[1]]))
+		target := text[start:end]
+		if !strings.Contains(strings.ToLower(target), "://") {
+			target = "https://" + target
+		}
+		if u, err := url.Parse(target); err != nil || u.Host == "" || !free(start, end) {
+			continue
+		}
+		e := rawEntity{TextEntity: TextEntity{Type: EntityURL, URL: target}, start: start, end: end}
+		p.entities, taken = append(p.entities, e), append(taken, e)
+	}
+	for _, loc := range emailPattern.FindAllStringIndex(text, -1) {
+		if !free(loc[0], loc[1]) {
+			continue
+		}
+		e := rawEntity{TextEntity: TextEntity{Type: EntityEmail, URL: "mailto:" + text[loc[0]:loc[1]]}, start: loc[0], end: loc[1]}
+		p.entities, taken = append(p.entities, e), append(taken, e)
+	}
+	for _, loc := range phonePattern.FindAllStringIndex(text, -1) {
+		number := strings.Map(func(r rune) rune {
+			if unicode.IsDigit(r) || r == '+' {
+				return r
+			}
+			return -1
+		}, text[loc[0]:loc[1]])
+		if digits := len(strings.TrimPrefix(number, "+")); digits < 7 || digits > 15 || !free(loc[0], loc[1]) {
+			continue
+		}
+		e := rawEntity{TextEntity: TextEntity{Type: EntityPhone, URL: "tel:" + number}, start: loc[0], end: loc[1]}
+		p.entities, taken = append(p.entities, e), append(taken, e)
+	}
+}
+
+// Drop trailing punctuation that more likely ends the sentence than the link.
+func trimURL(u string) string {
+	for len(u) > 0 {
+		last := u[len(u)-1]
+		if last == ')' && strings.Count(u, "(") >= strings.Count(u, ")") {
+			break
+		}
+		if !strings.ContainsRune(".,;:!?)'\"*_~", rune(last)) {
+			break
+		}
+		u = u[:len(u)-1]
+	}
+	return u
+}
+
+// Offset in UTF-16 code units of byte offset off in s.
+func utf16Offset(s string, off int) int {
+	return utf16Len(s[:off])
+}
+
+// Byte offset in s of UTF-16 offset off, or -1 when it is out of range or splits a character.
+func byteOffset(s string, off int) int {
+	n := 0
+	for i, r := range s {
+		if n == off {
+			return i
+		}
+		if n > off {
+			return -1
+		}
+		n += utf16.RuneLen(r)
+	}
+	if n == off {
+		return len(s)
+	}
+	return -1
+}
+
+// Parse the markup of content, already sanitized. Returns the text without markup, or ""
+// when it is the same as content, and the entities in it, including the given mentions.
+func formatText(content string, mentions []Mention) (string, []TextEntity) {
+	p := &markupParser{in: content, pos: make([]int, len(content)+1)}
+	p.parse()
+	p.autolink()
+	text := p.out.String()
+
+	for _, m := range mentions {
+		start, end := byteOffset(content, m.Offset), byteOffset(content, m.Offset+m.Length)
+		if start < 0 || end < 0 || p.pos[start] >= p.pos[end] {
+			continue
+		}
+		p.entities = append(p.entities, rawEntity{TextEntity: TextEntity{Type: EntityMention, UserID: m.UserID}, start: p.pos[start], end: p.pos[end]})
+	}
+
+	sort.SliceStable(p.entities, func(i, j int) bool {
+		a, b := p.entities[i], p.entities[j]
+		if a.start != b.start {
+			return a.start < b.start
+		}
+		return a.end > b.end // Enclosing entities first.
+	})
+	var entities []TextEntity
+	for _, e := range p.entities {
+		e.Offset = utf16Offset(text, e.start)
+		e.Length = utf16Offset(text, e.end) - e.Offset
+		entities = append(entities, e.TextEntity)
+	}
+
+	if text == content {
+		text = ""
+	}
+	return text, entities
+}
+
+// --- Handlers ---
+
+// Preview how content will be formatted, without sending it.
+func formatTextHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	_, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Content string `json:"content"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request data", http.StatusBadRequest)
+		return
+	}
+	content, err := sanitizeText(req.Content, maxContentLength)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	text, entities := formatText(content, nil)
+	if text == "" {
+		text = content
+	}
+	if entities == nil {
+		entities = []TextEntity{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Text     string       `json:"text"`
+		Entities []TextEntity `json:"entities"`
+	}{
+		Text:     text,
+		Entities: entities,
+	})
+}
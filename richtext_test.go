@@ -0,0 +1,134 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFormatText(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		mentions []Mention
+		text     string // "" when the text is the content.
+		entities []TextEntity
+	}{
+		{
+			name:     "inline markers",
+			content:  "*bold* and _it_ ~gone~",
+			text:     "bold and it gone",
+			entities: []TextEntity{{Type: EntityBold, Offset: 0, Length: 4}, {Type: EntityItalic, Offset: 9, Length: 2}, {Type: EntityStrike, Offset: 12, Length: 4}},
+		},
+		{
+			name:     "nested markers",
+			content:  "*bold _both_*",
+			text:     "bold both",
+			entities: []TextEntity{{Type: EntityBold, Offset: 0, Length: 9}, {Type: EntityItalic, Offset: 5, Length: 4}},
+		},
+		{
+			name:    "unclosed marker",
+			content: "*not closed and _neither",
+		},
+		{
+			name:    "markers inside words",
+			content: "2*3*4 snake_case_name",
+		},
+		{
+			name:     "no markup inside code",
+			content:  "`*x*` then *y*",
+			text:     "*x* then y",
+			entities: []TextEntity{{Type: EntityCode, Offset: 0, Length: 3}, {Type: EntityBold, Offset: 9, Length: 1}},
+		},
+		{
+			name:     "fenced block across lines",
+			content:  "```\nfunc *main*\n```",
+			text:     "func *main*",
+			entities: []TextEntity{{Type: EntityPre, Offset: 0, Length: 11}},
+		},
+		{
+			name:     "multi-line quote with inline markup",
+			content:  "> first\n> *second* line\n> `third`",
+			text:     "first\nsecond line\nthird",
+			entities: []TextEntity{{Type: EntityQuote, Offset: 0, Length: 23}, {Type: EntityBold, Offset: 6, Length: 6}, {Type: EntityCode, Offset: 18, Length: 5}},
+		},
+		{
+			name:     "quotes split by another line",
+			content:  "> a\nb\n> c",
+			text:     "a\nb\nc",
+			entities: []TextEntity{{Type: EntityQuote, Offset: 0, Length: 1}, {Type: EntityQuote, Offset: 4, Length: 1}},
+		},
+		{
+			name:     "lists",
+			content:  "- one\n* two\n12. three",
+			text:     "one\ntwo\nthree",
+			entities: []TextEntity{{Type: EntityBullet, Offset: 0, Length: 3}, {Type: EntityBullet, Offset: 4, Length: 3}, {Type: EntityNumbered, Offset: 8, Length: 5, Ordinal: 12}},
+		},
+		{
+			name:     "UTF-16 offsets after astral characters",
+			content:  "😀 *hi* 𝄞 _é_",
+			text:     "😀 hi 𝄞 é",
+			entities: []TextEntity{{Type: EntityBold, Offset: 3, Length: 2}, {Type: EntityItalic, Offset: 9, Length: 1}},
+		},
+		{
+			name:     "mentions are moved past removed markup",
+			content:  "*x* 😀 @bob",
+			mentions: []Mention{{UserID: "u1", Offset: 7, Length: 4}},
+			text:     "x 😀 @bob",
+			entities: []TextEntity{{Type: EntityBold, Offset: 0, Length: 1}, {Type: EntityMention, Offset: 5, Length: 4, UserID: "u1"}},
+		},
+		{
+			name:     "mentions splitting a character are dropped",
+			content:  "😀 @bob",
+			mentions: []Mention{{UserID: "u1", Offset: 1, Length: 4}},
+		},
+		{
+			name:    "autolinks outside code only",
+			content: "`https://example.com` and https://example.org/a_(b). ```www.example.net```",
+			text:    "https://example.com and https://example.org/a_(b). www.example.net",
+			entities: []TextEntity{
+				{Type: EntityCode, Offset: 0, Length: 19},
+				{Type: EntityURL, Offset: 24, Length: 25, URL: "https://example.org/a_(b)"},
+				{Type: EntityCode, Offset: 51, Length: 15},
+			},
+		},
+		{
+			name:     "www links, e-mail addresses and phone numbers",
+			content:  "see www.example.com, mail a@b.co or call +1 555 123 4567",
+			entities: []TextEntity{{Type: EntityURL, Offset: 4, Length: 15, URL: "https://www.example.com"}, {Type: EntityEmail, Offset: 26, Length: 6, URL: "mailto:a@b.co"}, {Type: EntityPhone, Offset: 41, Length: 15, URL: "tel:+15551234567"}},
+		},
+	}
+	for _, tt := range tests {
+		text, entities := formatText(tt.content, tt.mentions)
+		if text != tt.text {
+			t.Errorf("%s: text %q, want %q", tt.name, text, tt.text)
+		}
+		if !reflect.DeepEqual(entities, tt.entities) {
+			t.Errorf("%s:\n got  %+v\n want %+v", tt.name, entities, tt.entities)
+		}
+	}
+}
+
+func TestSanitizeText(t *testing.T) {
+	tests := []struct {
+		in    string
+		limit int
+		want  string
+		err   error
+	}{
+		{"a\r\nb\tc", 10, "a\nb\tc", nil},
+		{"👨‍👩‍👧", 5, "👨‍👩‍👧", nil},
+		{strings.Repeat("é", 4), 4, strings.Repeat("é", 4), nil},
+		{strings.Repeat("é", 5), 4, "", errTextTooLong},
+		{"bad \xff byte", 100, "", errTextInvalidUTF8},
+		{"bell \a", 100, "", errTextControlChars},
+		{"evil \u202Etxt.exe", 100, "", errTextControlChars},
+		{"isolate \u2067x", 100, "", errTextControlChars},
+	}
+	for _, tt := range tests {
+		got, err := sanitizeText(tt.in, tt.limit)
+		if got != tt.want || err != tt.err {
+			t.Errorf("sanitizeText(%q, %d) = %q, %v; want %q, %v", tt.in, tt.limit, got, err, tt.want, tt.err)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"nwr/utils"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Scheduled messages are kept in their own collection until they are due, so pending sends
+// survive restarts. The scheduler claims due messages one at a time and hands them to
+// deliverMessage, the same path an immediate send takes.
+
+const (
+	schedulerInterval = 5 * time.Second
+	maxScheduleAhead  = 365 * 24 * time.Hour
+	// A claimed message that is still "sending" after this long was interrupted by a crash.
+	scheduleClaimTimeout = time.Minute
+)
+
+const (
+	ScheduleStatusPending = "pending"
+	ScheduleStatusSending = "sending"
+)
+
+type ScheduledMessage struct {
+	Message   Message   `json:"message" bson:"message"`
+	SendAt    time.Time `json:"sendat" bson:"sendat"`
+	Status    string    `json:"status" bson:"status"`
+	ClaimedAt time.Time `json:"-" bson:"claimedat,omitempty"`
+}
+
+func parseSendAt(v string) (time.Time, error) {
+	sendAt, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return sendAt, errors.New("send_at must be an RFC 3339 time")
+	}
+	if !sendAt.After(time.Now()) {
+		return sendAt, errors.New("send_at must be in the future")
+	}
+	if sendAt.After(time.Now().Add(maxScheduleAhead)) {
+		return sendAt, errors.New("send_at is too far in the future")
+	}
+	return sendAt, nil
+}
+
+func scheduleMessage(msg Message, sendAt time.Time) (ScheduledMessage, error) {
+	scheduled := ScheduledMessage{Message: msg, SendAt: sendAt, Status: ScheduleStatusPending}
+	_, err := scheduledCollection.InsertOne(ctx, scheduled)
+	return scheduled, err
+}
+
+// Deliver due scheduled messages, close due polls and end expired live locations,
+// alongside the Redis flusher.
+func runScheduler() {
+	ticker := time.NewTicker(schedulerInterval)
+	for range ticker.C {
+		// Put back messages whose delivery was interrupted.
+		_, err := scheduledCollection.UpdateMany(ctx,
+			bson.M{"status": ScheduleStatusSending, "claimedat": bson.M{"$lt": time.Now().Add(-scheduleClaimTimeout)}},
+			bson.M{"$set": bson.M{"status": ScheduleStatusPending}})
+		if err != nil {
+			log.Println("Scheduler reset error:", err)
+		}
+
+		for {
+			var scheduled ScheduledMessage
+			err := scheduledCollection.FindOneAndUpdate(ctx,
+				bson.M{"status": ScheduleStatusPending, "sendat": bson.M{"$lte": time.Now()}},
+				bson.M{"$set": bson.M{"status": ScheduleStatusSending, "claimedat": time.Now()}},
+				options.FindOneAndUpdate().SetSort(bson.M{"sendat": 1}),
+			).Decode(&scheduled)
+			if err == mongo.ErrNoDocuments {
+				break
+			} else if err != nil {
+				log.Println("Scheduler claim error:", err)
+				break
+			}
+			deliverScheduled(scheduled)
+		}
+
+		closeDuePolls()
+		stopExpiredLiveLocations()
+	}
+}
+
+func deliverScheduled(scheduled ScheduledMessage) {
+	msg := scheduled.Message
+	msg.CreatedAt = time.Now()
+
+	// A previous attempt may have saved the message before being interrupted.
+	n, err := messagesCollection.CountDocuments(ctx, bson.M{"message_id": msg.MessageID})
+	if err != nil {
+		log.Println("Scheduler lookup error:", err)
+		return
+	}
+	if n == 0 {
+		if msg.ThreadID != "" {
+			if _, err := getThreadRoot(msg.ChatID, msg.ThreadID); err != nil {
+				msg.ThreadID = "" // The thread is gone; deliver to the chat instead.
+			}
+		}
+		if err := deliverMessage(&msg); err != nil {
+			log.Println("Failed to deliver scheduled message:", msg.MessageID, err)
+			return // Retried once the claim times out.
+		}
+	}
+
+	if _, err := scheduledCollection.DeleteOne(ctx, bson.M{"message.message_id": msg.MessageID}); err != nil {
+		log.Println("Failed to remove delivered scheduled message:", msg.MessageID, err)
+	}
+}
+
+// Files held by scheduled messages that have not been delivered yet.
+func scheduledMessageFiles(files map[string]bool) error {
+	opts := options.Find().SetProjection(bson.M{"message.filename": 1})
+	cur, err := scheduledCollection.Find(ctx, bson.M{"message.filename": bson.M{"$exists": true, "$ne": ""}}, opts)
+	if err != nil {
+		return err
+	}
+	var scheduled []ScheduledMessage
+	if err := cur.All(ctx, &scheduled); err != nil {
+		return err
+	}
+	for _, s := range scheduled {
+		files[s.Message.File] = true
+	}
+	return nil
+}
+
+// --- Handlers ---
+
+// List the user's pending scheduled messages, soonest first.
+func scheduledMessagesHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	filter := bson.M{"message.sender": claims.UserID, "status": ScheduleStatusPending}
+	if chatID := r.URL.Query().Get("chat_id"); chatID != "" {
+		filter["message.chat_id"] = chatID
+	}
+	cur, err := scheduledCollection.Find(ctx, filter, options.Find().SetSort(bson.M{"sendat": 1}))
+	if err != nil {
+		http.Error(w, "Failed to fetch scheduled messages", http.StatusInternalServerError)
+		return
+	}
+	scheduled := []ScheduledMessage{}
+	if err := cur.All(ctx, &scheduled); err != nil {
+		http.Error(w, "Failed to fetch scheduled messages", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(scheduled)
+}
+
+// Change the text or delivery time of a pending scheduled message.
+func editScheduledMessageHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPut {
+		http.Error(w, "Invalid Method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Content  *string   `json:"content"`
+		Mentions []Mention `json:"mentions"`
+		Caption  *string   `json:"caption"`
+		SendAt   string    `json:"send_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request data", http.StatusBadRequest)
+		return
+	}
+
+	// Only pending messages can change; one being delivered right now can't.
+	filter := bson.M{"message.message_id": ps.ByName("id"), "message.sender": claims.UserID, "status": ScheduleStatusPending}
+
+	update := bson.M{}
+	if req.Content != nil {
+		content, err := sanitizeText(*req.Content, maxContentLength)
+		if err != nil {
+			http.Error(w, "content: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Content = &content
+		var scheduled ScheduledMessage
+		if err := scheduledCollection.FindOne(ctx, filter).Decode(&scheduled); err == mongo.ErrNoDocuments {
+			http.Error(w, "Scheduled message not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to fetch scheduled message", http.StatusInternalServerError)
+			return
+		}
+		mentions, err := chatMentions(scheduled.Message.ChatID, *req.Content, req.Mentions)
+		if isMentionError(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil && err != mongo.ErrNoDocuments {
+			http.Error(w, "Failed to check mentions", http.StatusInternalServerError)
+			return
+		}
+		update["message.content"] = *req.Content
+		update["message.mentions"] = mentions
+		update["message.text"], update["message.entities"] = formatText(*req.Content, mentions)
+	}
+	if req.Caption != nil {
+		caption, err := sanitizeText(*req.Caption, maxCaptionLength)
+		if err != nil {
+			http.Error(w, "caption: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		update["message.caption"] = caption
+	}
+	if req.SendAt != "" {
+		sendAt, err := parseSendAt(req.SendAt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		update["sendat"] = sendAt
+	}
+	if len(update) == 0 {
+		http.Error(w, "Nothing to update", http.StatusBadRequest)
+		return
+	}
+
+	var scheduled ScheduledMessage
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = scheduledCollection.FindOneAndUpdate(ctx, filter, bson.M{"$set": update}, opts).Decode(&scheduled)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Scheduled message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to update scheduled message", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(scheduled)
+}
+
+// Cancel a pending scheduled message.
+func cancelScheduledMessageHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Invalid Method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter := bson.M{"message.message_id": ps.ByName("id"), "message.sender": claims.UserID, "status": ScheduleStatusPending}
+	var scheduled ScheduledMessage
+	err = scheduledCollection.FindOneAndDelete(ctx, filter).Decode(&scheduled)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Scheduled message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to cancel scheduled message", http.StatusInternalServerError)
+		return
+	}
+	releaseMessageMedia(scheduled.Message)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bson.M{"message_id": scheduled.Message.MessageID, "cancelled": true})
+}
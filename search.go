@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"log"
+	"net/http"
+	"nwr/utils"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 50
+	snippetRadius      = 60 // Characters of context kept around the first match.
+)
+
+type SearchQuery struct {
+	Terms   []string // Lower-cased; a message must contain all of them.
+	ChatIDs []string
+	Sender  string
+	From    time.Time // Inclusive; zero means unbounded.
+	To      time.Time // Exclusive; zero means unbounded.
+	// Cursor: only messages after the one created at Before with ID BeforeID, newest first.
+	Before   time.Time
+	BeforeID string
+	Limit    int
+}
+
+// A SearchEngine finds messages matching a query, newest first.
+// The Mongo text index is used in production; memorySearchEngine searches a fixed set of
+// messages in-process and also serves as a stand-in in tests.
+type SearchEngine interface {
+	Search(q SearchQuery) ([]Message, error)
+}
+
+var searchEngine SearchEngine = mongoSearchEngine{}
+
+type mongoSearchEngine struct{}
+
+// Create the text index over message content and captions.
+func ensureSearchIndex() error {
+	_, err := messagesCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "content", Value: "text"}, {Key: "caption", Value: "text"}},
+	})
+	return err
+}
+
+func (mongoSearchEngine) Search(q SearchQuery) ([]Message, error) {
+	// Quoting every term makes $text require all of them.
+	phrases := make([]string, len(q.Terms))
+	for i, t := range q.Terms {
+		phrases[i] = `"` + strings.ReplaceAll(t, `"`, "") + `"`
+	}
+
+	filter := bson.M{
+		"$text":   bson.M{"$search": strings.Join(phrases, " ")},
+		"chat_id": bson.M{"$in": q.ChatIDs},
+		"deleted": false,
+	}
+	if q.Sender != "" {
+		filter["sender"] = q.Sender
+	}
+	created := bson.M{}
+	if !q.From.IsZero() {
+		created["$gte"] = q.From
+	}
+	if !q.To.IsZero() {
+		created["$lt"] = q.To
+	}
+	if len(created) > 0 {
+		filter["createdat"] = created
+	}
+	if !q.Before.IsZero() {
+		for k, v := range cursorFilter("createdat", "message_id", q.Before, q.BeforeID, false) {
+			filter[k] = v // The filter has no $or of its own.
+		}
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "createdat", Value: -1}, {Key: "message_id", Value: -1}}).SetLimit(int64(q.Limit))
+	cur, err := messagesCollection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []Message
+	err = cur.All(ctx, &msgs)
+	return msgs, err
+}
+
+type memorySearchEngine struct {
+	Messages []Message
+}
+
+func (e memorySearchEngine) Search(q SearchQuery) ([]Message, error) {
+	var hits []Message
+	for _, m := range e.Messages {
+		if m.Deleted || !utils.Contains(q.ChatIDs, m.ChatID) {
+			continue
+		}
+		if q.Sender != "" && m.Sender != q.Sender {
+			continue
+		}
+		if (!q.From.IsZero() && m.CreatedAt.Before(q.From)) ||
+			(!q.To.IsZero() && !m.CreatedAt.Before(q.To)) ||
+			(!q.Before.IsZero() && !newerFirst(Message{CreatedAt: q.Before, MessageID: q.BeforeID}, m)) {
+			continue
+		}
+		if !matchesAllTerms(m.Content+"\n"+m.Caption, q.Terms) {
+			continue
+		}
+		hits = append(hits, m)
+	}
+	sortNewestFirst(hits)
+	if len(hits) > q.Limit {
+		hits = hits[:q.Limit]
+	}
+	return hits, nil
+}
+
+func matchesAllTerms(text string, terms []string) bool {
+	text = strings.ToLower(text)
+	for _, t := range terms {
+		if !strings.Contains(text, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether a comes before b newest first, as the search cursor orders messages.
+func newerFirst(a, b Message) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.After(b.CreatedAt)
+	}
+	return a.MessageID > b.MessageID
+}
+
+func sortNewestFirst(msgs []Message) {
+	sort.SliceStable(msgs, func(i, j int) bool { return newerFirst(msgs[i], msgs[j]) })
+}
+
+// Messages of the given chats still waiting in Redis to be flushed to MongoDB.
+func bufferedMessages(chatIDs []string) []Message {
+	var msgs []Message
+	for _, chatID := range chatIDs {
+		entries, err := redisClient.LRange(ctx, "chat:"+chatID+":messages", 0, -1).Result()
+		if err != nil {
+			log.Println("Redis LRange error:", err)
+			continue
+		}
+		for _, mStr := range entries {
+			var m Message
+			if err := json.Unmarshal([]byte(mStr), &m); err != nil {
+				log.Println("JSON unmarshal error:", err)
+				continue
+			}
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs
+}
+
+// Run the query against the configured engine and the Redis buffer, merging the results.
+func searchMessages(q SearchQuery) ([]Message, error) {
+	stored, err := searchEngine.Search(q)
+	if err != nil {
+		return nil, err
+	}
+	buffered, err := memorySearchEngine{Messages: bufferedMessages(q.ChatIDs)}.Search(q)
+	if err != nil {
+		return nil, err
+	}
+
+	// A message may be in both while a flush is in progress.
+	seen := make(map[string]bool)
+	var merged []Message
+	for _, m := range append(buffered, stored...) {
+		if seen[m.MessageID] {
+			continue
+		}
+		seen[m.MessageID] = true
+		merged = append(merged, m)
+	}
+	sortNewestFirst(merged)
+	if len(merged) > q.Limit {
+		merged = merged[:q.Limit]
+	}
+	return merged, nil
+}
+
+// Cut a snippet around the first match and wrap every term in <mark> tags.
+// The rest of the text is HTML-escaped.
+func highlightSnippet(text string, terms []string) string {
+	lower := strings.ToLower(text)
+	if len(lower) != len(text) {
+		// Lower-casing changed byte offsets; fall back to case-sensitive matching.
+		lower = text
+	}
+	start := -1
+	for _, t := range terms {
+		if i := strings.Index(lower, t); i >= 0 && (start < 0 || i < start) {
+			start = i
+		}
+	}
+	if start < 0 {
+		start = 0
+	}
+
+	from, to := max(0, start-snippetRadius), min(len(text), start+snippetRadius)
+	// Don't cut multi-byte characters in half.
+	for from > 0 && !utf8.RuneStart(text[from]) {
+		from--
+	}
+	for to < len(text) && !utf8.RuneStart(text[to]) {
+		to++
+	}
+
+	var sb strings.Builder
+	if from > 0 {
+		sb.WriteString("…")
+	}
+	segment, lowerSegment := text[from:to], lower[from:to]
+	for i := 0; i < len(segment); {
+		matched := ""
+		for _, t := range terms {
+			if t != "" && strings.HasPrefix(lowerSegment[i:], t) && len(t) > len(matched) {
+				matched = t
+			}
+		}
+		if matched != "" {
+			sb.WriteString("<mark>" + html.EscapeString(segment[i:i+len(matched)]) + "</mark>")
+			i += len(matched)
+			continue
+		}
+		_, size := utf8.DecodeRuneInString(segment[i:])
+		sb.WriteString(html.EscapeString(segment[i : i+size]))
+		i += size
+	}
+	if to < len(text) {
+		sb.WriteString("…")
+	}
+	return sb.String()
+}
+
+// --- Handlers ---
+
+// Search messages in the user's chats. Supports chat_id, sender, from and to (RFC 3339)
+// filters; pages are requested with ?cursor=<next_cursor of the previous page>.
+func searchHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	terms := strings.Fields(strings.ToLower(query.Get("q")))
+	if len(terms) == 0 {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+
+	chatIDs, err := userChatIDs(claims.UserID)
+	if err != nil {
+		http.Error(w, "Failed to fetch chats", http.StatusInternalServerError)
+		return
+	}
+	if chatID := query.Get("chat_id"); chatID != "" {
+		if !utils.Contains(chatIDs, chatID) {
+			http.Error(w, "Chat not found", http.StatusNotFound)
+			return
+		}
+		chatIDs = []string{chatID}
+	}
+
+	q := SearchQuery{
+		Terms:   terms,
+		ChatIDs: chatIDs,
+		Sender:  query.Get("sender"),
+		Limit:   defaultSearchLimit,
+	}
+	if l, err := strconv.Atoi(query.Get("limit")); err == nil && l > 0 {
+		q.Limit = min(l, maxSearchLimit)
+	}
+	for name, dst := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+		if v := query.Get(name); v != "" {
+			if *dst, err = time.Parse(time.RFC3339, v); err != nil {
+				http.Error(w, "Invalid "+name+" date", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if cursor := query.Get("cursor"); cursor != "" {
+		var ok bool
+		if q.Before, q.BeforeID, ok = decodeCursor(cursor); !ok {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	msgs, err := searchMessages(q)
+	if err != nil {
+		http.Error(w, "Search failed", http.StatusInternalServerError)
+		return
+	}
+
+	type searchResult struct {
+		Message Message `json:"message"`
+		Snippet string  `json:"snippet"`
+	}
+	results := []searchResult{}
+	for _, m := range msgs {
+		text := m.Content
+		if !matchesAllTerms(text, terms[:1]) && m.Caption != "" {
+			text = m.Caption
+		}
+		results = append(results, searchResult{Message: m, Snippet: highlightSnippet(text, terms)})
+	}
+
+	var nextCursor string
+	if len(msgs) == q.Limit {
+		last := msgs[len(msgs)-1]
+		nextCursor = encodeCursor(last.CreatedAt, last.MessageID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Results    []searchResult `json:"results"`
+		NextCursor string         `json:"next_cursor,omitempty"`
+	}{
+		Results:    results,
+		NextCursor: nextCursor,
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMemorySearchEngine(t *testing.T) {
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return base.Add(time.Duration(minutes) * time.Minute) }
+	engine := memorySearchEngine{Messages: []Message{
+		{MessageID: "m1", ChatID: "c1", Sender: "alice", Content: "Lunch at noon?", CreatedAt: at(1)},
+		{MessageID: "m2", ChatID: "c1", Sender: "bob", Content: "Noon works, see you at LUNCH", CreatedAt: at(2)},
+		{MessageID: "m3", ChatID: "c2", Sender: "alice", Content: "lunch plans", CreatedAt: at(3)},
+		{MessageID: "m4", ChatID: "c1", Sender: "alice", Caption: "Lunch menu at noon", CreatedAt: at(4)},
+		{MessageID: "m5", ChatID: "c1", Sender: "alice", Content: "lunch at noon, deleted", CreatedAt: at(5), Deleted: true},
+		{MessageID: "m6", ChatID: "c1", Sender: "bob", Content: "dinner instead", CreatedAt: at(6)},
+	}}
+
+	tests := []struct {
+		name string
+		q    SearchQuery
+		want []string
+	}{
+		{"all terms, newest first", SearchQuery{Terms: []string{"lunch", "noon"}, ChatIDs: []string{"c1", "c2"}}, []string{"m4", "m2", "m1"}},
+		{"only the given chats", SearchQuery{Terms: []string{"lunch"}, ChatIDs: []string{"c2"}}, []string{"m3"}},
+		{"no chats", SearchQuery{Terms: []string{"lunch"}}, nil},
+		{"sender", SearchQuery{Terms: []string{"lunch"}, ChatIDs: []string{"c1", "c2"}, Sender: "alice"}, []string{"m4", "m3", "m1"}},
+		{"from is inclusive, to exclusive", SearchQuery{Terms: []string{"lunch"}, ChatIDs: []string{"c1", "c2"}, From: at(2), To: at(4)}, []string{"m3", "m2"}},
+		{"before cursor", SearchQuery{Terms: []string{"lunch"}, ChatIDs: []string{"c1", "c2"}, Before: at(3)}, []string{"m2", "m1"}},
+		{"limit", SearchQuery{Terms: []string{"lunch"}, ChatIDs: []string{"c1", "c2"}, Limit: 2}, []string{"m4", "m3"}},
+		{"no match", SearchQuery{Terms: []string{"lunch", "dinner"}, ChatIDs: []string{"c1", "c2"}}, nil},
+	}
+	for _, tt := range tests {
+		if tt.q.Limit == 0 {
+			tt.q.Limit = defaultSearchLimit
+		}
+		msgs, err := engine.Search(tt.q)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, m := range msgs {
+			got = append(got, m.MessageID)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMemorySearchEngineCursor(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	engine := memorySearchEngine{Messages: []Message{
+		{MessageID: "a", ChatID: "c1", Content: "same time", CreatedAt: at},
+		{MessageID: "c", ChatID: "c1", Content: "same time", CreatedAt: at},
+		{MessageID: "b", ChatID: "c1", Content: "same time", CreatedAt: at},
+		{MessageID: "d", ChatID: "c1", Content: "same time", CreatedAt: at.Add(-time.Second)},
+		{MessageID: "e", ChatID: "c1", Content: "same time", CreatedAt: at.Add(time.Second)},
+	}}
+
+	// Page through two at a time, as the handler does with next_cursor.
+	q := SearchQuery{Terms: []string{"same"}, ChatIDs: []string{"c1"}, Limit: 2}
+	var got []string
+	for page := 0; page < 5; page++ {
+		msgs, err := engine.Search(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range msgs {
+			got = append(got, m.MessageID)
+		}
+		if len(msgs) < q.Limit {
+			break
+		}
+		last := msgs[len(msgs)-1]
+		var ok bool
+		if q.Before, q.BeforeID, ok = decodeCursor(encodeCursor(last.CreatedAt, last.MessageID)); !ok {
+			t.Fatal("cursor did not round-trip")
+		}
+	}
+	if want := []string{"e", "c", "b", "a", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestHighlightSnippet(t *testing.T) {
+	tests := []struct {
+		text  string
+		terms []string
+		want  string
+	}{
+		{"See you at Lunch <b>", []string{"lunch"}, "See you at <mark>Lunch</mark> &lt;b&gt;"},
+		{"lunch and lunchbox", []string{"lunch", "lunchbox"}, "<mark>lunch</mark> and <mark>lunchbox</mark>"},
+		{"nothing here", []string{"lunch"}, "nothing here"},
+	}
+	for _, tt := range tests {
+		if got := highlightSnippet(tt.text, tt.terms); got != tt.want {
+			t.Errorf("highlightSnippet(%q, %q) = %q, want %q", tt.text, tt.terms, got, tt.want)
+		}
+	}
+}
+
+func TestIsChatMember(t *testing.T) {
+	if !isChatMember(Chat{}, "alice") || !isChatMember(Chat{Members: []string{}}, "alice") {
+		t.Error("chats without members should be open to everyone")
+	}
+	if !isChatMember(Chat{Members: []string{"alice", "bob"}}, "bob") || isChatMember(Chat{Members: []string{"alice"}}, "bob") {
+		t.Error("chats with members should only be open to them")
+	}
+}
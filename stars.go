@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"nwr/utils"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultStarredLimit = 30
+	maxStarredLimit     = 100
+)
+
+// A message bookmarked by a user.
+type Star struct {
+	UserID    string    `json:"user_id" bson:"user_id"`
+	MessageID string    `json:"message_id" bson:"message_id"`
+	ChatID    string    `json:"chat_id" bson:"chat_id"`
+	StarredAt time.Time `json:"starredat" bson:"starredat"`
+}
+
+func ensureStarIndex() error {
+	_, err := starsCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "message_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// Drop every star of the messages matching filter (by message_id or chat_id).
+func removeStars(filter bson.M) {
+	if _, err := starsCollection.DeleteMany(ctx, filter); err != nil {
+		log.Println("Failed to remove stars:", err)
+	}
+}
+
+// --- Handlers ---
+
+// Star a message.
+func starMessageHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	msg, err := getMemberMessage(ps.ByName("id"), claims.UserID)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch message", http.StatusInternalServerError)
+		return
+	}
+
+	star := Star{UserID: claims.UserID, MessageID: msg.MessageID, ChatID: msg.ChatID, StarredAt: time.Now()}
+	filter := bson.M{"user_id": star.UserID, "message_id": star.MessageID}
+	opts := options.Update().SetUpsert(true)
+	if _, err := starsCollection.UpdateOne(ctx, filter, bson.M{"$setOnInsert": star}, opts); err != nil {
+		http.Error(w, "Failed to star message", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bson.M{"message_id": msg.MessageID, "starred": true})
+}
+
+// Unstar a message.
+func unstarMessageHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	messageID := ps.ByName("id")
+	if _, err := starsCollection.DeleteOne(ctx, bson.M{"user_id": claims.UserID, "message_id": messageID}); err != nil {
+		http.Error(w, "Failed to unstar message", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bson.M{"message_id": messageID, "starred": false})
+}
+
+// List the user's starred messages in chats they still belong to, most recently starred first.
+// Pages are requested with ?before=<next_cursor of the previous page>.
+func starredHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	chatIDs, err := userChatIDs(claims.UserID)
+	if err != nil {
+		http.Error(w, "Failed to fetch chats", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	limit := int64(defaultStarredLimit)
+	if l, err := strconv.ParseInt(query.Get("limit"), 10, 64); err == nil && l > 0 {
+		limit = min(l, maxStarredLimit)
+	}
+
+	filter := bson.M{"user_id": claims.UserID, "chat_id": bson.M{"$in": chatIDs}}
+	if before := query.Get("before"); before != "" {
+		starredAt, messageID, ok := decodeCursor(before)
+		if !ok {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		filter["$or"] = cursorFilter("starredat", "message_id", starredAt, messageID, false)["$or"]
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "starredat", Value: -1}, {Key: "message_id", Value: -1}}).SetLimit(limit)
+	cur, err := starsCollection.Find(ctx, filter, opts)
+	if err != nil {
+		http.Error(w, "Failed to fetch starred messages", http.StatusInternalServerError)
+		return
+	}
+	var stars []Star
+	if err := cur.All(ctx, &stars); err != nil {
+		http.Error(w, "Failed to fetch starred messages", http.StatusInternalServerError)
+		return
+	}
+
+	type starredMessage struct {
+		StarredAt time.Time `json:"starredat"`
+		Message   Message   `json:"message"`
+	}
+	starred := []starredMessage{}
+	for _, s := range stars {
+		msg, err := getMessage(s.ChatID, s.MessageID)
+		if err != nil {
+			continue
+		}
+		msg.ReactionSummary = summarizeReactions(msg.Reactions, claims.UserID)
+		starred = append(starred, starredMessage{StarredAt: s.StarredAt, Message: msg})
+	}
+
+	var nextCursor string
+	if int64(len(stars)) == limit {
+		last := stars[len(stars)-1]
+		nextCursor = encodeCursor(last.StarredAt, last.MessageID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Messages   []starredMessage `json:"messages"`
+		NextCursor string           `json:"next_cursor,omitempty"`
+	}{
+		Messages:   starred,
+		NextCursor: nextCursor,
+	})
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"nwr/utils"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Storage usage is the total size of the files a user has sent in messages that still exist,
+// including scheduled ones. Deduplicated files are counted once per message, so usage does
+// not depend on what others sent. While a file is being stored its size is held against the
+// quota, so concurrent sends can't together exceed a quota each of them fits on its own.
+
+var (
+	userStorageQuota = utils.EnvInt64("USER_STORAGE_QUOTA_BYTES", 5<<30) // 5GB
+	chatStorageQuota = utils.EnvInt64("CHAT_STORAGE_QUOTA_BYTES", 2<<30) // 2GB per user per chat
+)
+
+const (
+	largestFilesPerChat = 5
+	// Holds are released once their file is counted; ones left by failed requests expire.
+	quotaHoldTimeout = 10 * time.Minute
+)
+
+var errStorageQuota = errors.New("storage quota exceeded")
+
+type ChatStorage struct {
+	ChatID       string       `json:"chat_id" bson:"_id"`
+	Name         string       `json:"name" bson:"-"`
+	UsedBytes    int64        `json:"used_bytes" bson:"used_bytes"`
+	Files        int          `json:"files" bson:"files"`
+	LargestFiles []StoredFile `json:"largest_files" bson:"-"`
+}
+
+type StoredFile struct {
+	MessageID    string    `json:"message_id" bson:"message_id"`
+	File         string    `json:"filename" bson:"filename"`
+	OriginalName string    `json:"original_name,omitempty" bson:"original_name,omitempty"`
+	Size         int64     `json:"size" bson:"size"`
+	CreatedAt    time.Time `json:"createdat" bson:"createdat"`
+}
+
+func userMediaFilter(userID string) bson.M {
+	return bson.M{"sender": userID, "deleted": false, "size": bson.M{"$gt": 0}}
+}
+
+// Bytes stored by a user, per chat, largest first.
+func userChatStorage(userID string) ([]ChatStorage, error) {
+	pipeline := []bson.M{
+		{"$match": userMediaFilter(userID)},
+		{"$group": bson.M{"_id": "$chat_id", "used_bytes": bson.M{"$sum": "$size"}, "files": bson.M{"$sum": 1}}},
+		{"$sort": bson.M{"used_bytes": -1}},
+	}
+	cur, err := messagesCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var usage []ChatStorage
+	if err := cur.All(ctx, &usage); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+func sumSizes(coll *mongo.Collection, filter bson.M, field string) (int64, error) {
+	pipeline := []bson.M{
+		{"$match": filter},
+		{"$group": bson.M{"_id": nil, "used_bytes": bson.M{"$sum": "$" + field}}},
+	}
+	cur, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, err
+	}
+	var result []struct {
+		UsedBytes int64 `bson:"used_bytes"`
+	}
+	if err := cur.All(ctx, &result); err != nil || len(result) == 0 {
+		return 0, err
+	}
+	return result[0].UsedBytes, nil
+}
+
+// Bytes stored by a user in sent and scheduled messages, in one chat or all when chatID is "".
+func storageUsed(userID, chatID string) (int64, error) {
+	filter := userMediaFilter(userID)
+	scheduledFilter := bson.M{"message.sender": userID, "message.size": bson.M{"$gt": 0}}
+	if chatID != "" {
+		filter["chat_id"] = chatID
+		scheduledFilter["message.chat_id"] = chatID
+	}
+	sent, err := sumSizes(messagesCollection, filter, "size")
+	if err != nil {
+		return 0, err
+	}
+	scheduled, err := sumSizes(scheduledCollection, scheduledFilter, "message.size")
+	if err != nil {
+		return 0, err
+	}
+	return sent + scheduled, nil
+}
+
+type quotaHold struct {
+	ID        string    `bson:"id"`
+	Size      int64     `bson:"size"`
+	ExpiresAt time.Time `bson:"expiresat"`
+}
+
+// Add hold to the holds under key if, with the bytes already used, they stay within limit.
+// Expired holds are dropped in the same update.
+func holdQuota(key string, hold quotaHold, used, limit int64) error {
+	update := []bson.M{
+		{"$set": bson.M{"holds": bson.M{"$filter": bson.M{
+			"input": bson.M{"$ifNull": bson.A{"$holds", bson.A{}}},
+			"cond":  bson.M{"$gt": bson.A{"$$this.expiresat", time.Now()}},
+		}}}},
+		{"$set": bson.M{"holds": bson.M{"$cond": bson.A{
+			bson.M{"$lte": bson.A{bson.M{"$add": bson.A{bson.M{"$sum": "$holds.size"}, used + hold.Size}}, limit}},
+			bson.M{"$concatArrays": bson.A{"$holds", bson.A{bson.M{"$literal": hold}}}},
+			"$holds",
+		}}}},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var doc struct {
+		Holds []quotaHold `bson:"holds"`
+	}
+	err := storageHoldsCollection.FindOneAndUpdate(ctx, bson.M{"_id": key}, update, opts).Decode(&doc)
+	if mongo.IsDuplicateKeyError(err) {
+		// A concurrent request created the document; update it now that it exists.
+		err = storageHoldsCollection.FindOneAndUpdate(ctx, bson.M{"_id": key}, update, opts).Decode(&doc)
+	}
+	if err != nil {
+		return err
+	}
+	for _, h := range doc.Holds {
+		if h.ID == hold.ID {
+			return nil
+		}
+	}
+	return errStorageQuota
+}
+
+// Hold size more bytes within the user's overall and per-chat quotas. The returned release
+// must be called once the file is counted in the usage, or won't be stored after all.
+func reserveStorageQuota(userID, chatID string, size int64) (func(), error) {
+	hold := quotaHold{ID: utils.GenerateStringName(16), Size: size, ExpiresAt: time.Now().Add(quotaHoldTimeout)}
+	var held []string
+	release := func() {
+		for _, key := range held {
+			_, err := storageHoldsCollection.UpdateOne(ctx, bson.M{"_id": key}, bson.M{"$pull": bson.M{"holds": bson.M{"id": hold.ID}}})
+			if err != nil {
+				log.Println("Failed to release storage quota:", key, err)
+			}
+		}
+	}
+
+	used, err := storageUsed(userID, "")
+	if err != nil {
+		return nil, err
+	}
+	pending, err := pendingUploadBytes(userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := holdQuota("user:"+userID, hold, used+pending, userStorageQuota); err != nil {
+		return nil, err
+	}
+	held = append(held, "user:"+userID)
+
+	if chatID != "" {
+		used, err := storageUsed(userID, chatID)
+		if err == nil {
+			err = holdQuota("chat:"+chatID+":"+userID, hold, used, chatStorageQuota)
+		}
+		if err != nil {
+			release()
+			return nil, err
+		}
+		held = append(held, "chat:"+chatID+":"+userID)
+	}
+	return release, nil
+}
+
+// --- Handlers ---
+
+// Report the user's storage usage per chat with the largest files in each.
+func storageHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	chats, err := userChatStorage(claims.UserID)
+	if err != nil {
+		http.Error(w, "Failed to fetch storage usage", http.StatusInternalServerError)
+		return
+	}
+
+	var total int64
+	for i := range chats {
+		total += chats[i].UsedBytes
+
+		var chat Chat
+		if err := chatsCollection.FindOne(ctx, bson.M{"chat_id": chats[i].ChatID}).Decode(&chat); err == nil {
+			chats[i].Name = chat.Name
+		}
+
+		filter := userMediaFilter(claims.UserID)
+		filter["chat_id"] = chats[i].ChatID
+		opts := options.Find().SetSort(bson.D{{Key: "size", Value: -1}}).SetLimit(largestFilesPerChat)
+		cur, err := messagesCollection.Find(ctx, filter, opts)
+		if err != nil {
+			log.Println("Largest files query error:", err)
+			continue
+		}
+		if err := cur.All(ctx, &chats[i].LargestFiles); err != nil {
+			log.Println("Decode stored file error:", err)
+		}
+	}
+
+	if len(chats) == 0 {
+		chats = []ChatStorage{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		UsedBytes      int64         `json:"used_bytes"`
+		QuotaBytes     int64         `json:"quota_bytes"`
+		ChatQuotaBytes int64         `json:"chat_quota_bytes"`
+		Chats          []ChatStorage `json:"chats"`
+	}{
+		UsedBytes:      total,
+		QuotaBytes:     userStorageQuota,
+		ChatQuotaBytes: chatStorageQuota,
+		Chats:          chats,
+	})
+}
+
+// Delete the user's media messages older than / larger than the given limits.
+func deleteMediaHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Invalid Method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ChatID        string `json:"chat_id"` // Optional; all chats when empty.
+		OlderThanDays int    `json:"older_than_days"`
+		LargerThan    int64  `json:"larger_than"`
+		DryRun        bool   `json:"dry_run"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request data", http.StatusBadRequest)
+		return
+	}
+	if req.OlderThanDays <= 0 && req.LargerThan <= 0 {
+		http.Error(w, "older_than_days or larger_than is required", http.StatusBadRequest)
+		return
+	}
+
+	filter := userMediaFilter(claims.UserID)
+	if req.ChatID != "" {
+		filter["chat_id"] = req.ChatID
+	}
+	if req.OlderThanDays > 0 {
+		filter["createdat"] = bson.M{"$lt": time.Now().AddDate(0, 0, -req.OlderThanDays)}
+	}
+	if req.LargerThan > 0 {
+		filter["size"] = bson.M{"$gt": req.LargerThan}
+	}
+
+	cur, err := messagesCollection.Find(ctx, filter)
+	if err != nil {
+		http.Error(w, "Failed to fetch media", http.StatusInternalServerError)
+		return
+	}
+	var msgs []Message
+	if err := cur.All(ctx, &msgs); err != nil {
+		http.Error(w, "Failed to fetch media", http.StatusInternalServerError)
+		return
+	}
+
+	deletedIDs := []string{}
+	var freed int64
+	for _, m := range msgs {
+		if !req.DryRun {
+			deleted, err := softDeleteMessage(m.ChatID, m.MessageID)
+			if err != nil {
+				log.Println("Failed to delete media message:", m.MessageID, err)
+				continue
+			}
+			if deleted == nil {
+				continue
+			}
+			releaseMessageMedia(*deleted)
+		}
+		deletedIDs = append(deletedIDs, m.MessageID)
+		freed += m.Size
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bson.M{"deleted": deletedIDs, "freed_bytes": freed, "dry_run": req.DryRun})
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const MessageTypeSystem = "system"
+
+// What a system message records, e.g. a pin or a settings change.
+type SystemEvent struct {
+	Action    string `json:"action" bson:"action"`
+	Actor     string `json:"actor" bson:"actor"`
+	MessageID string `json:"message_id,omitempty" bson:"message_id,omitempty"` // Message the event is about, if any.
+	Value     string `json:"value,omitempty" bson:"value,omitempty"`
+}
+
+// Record an event in the chat history and push it to live connections.
+func saveSystemMessage(chatID string, event SystemEvent) {
+	msg := Message{
+		MessageID: generateMessageID(),
+		ChatID:    chatID,
+		Type:      MessageTypeSystem,
+		Sender:    event.Actor,
+		Event:     &event,
+		CreatedAt: time.Now(),
+	}
+	if err := deliverMessage(&msg); err != nil {
+		log.Println("Failed to save system message:", err)
+	}
+}
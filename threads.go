@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"nwr/utils"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Threads: any top-level message can become a thread root. Replies carry the root's ID in
+// ThreadID and are left out of the main chat history; the root keeps a summary instead.
+
+const (
+	defaultThreadLimit = 30
+	maxThreadLimit     = 100
+)
+
+type ThreadSummary struct {
+	ReplyCount   int       `json:"reply_count" bson:"reply_count"`
+	LastReply    *Quote    `json:"last_reply,omitempty" bson:"last_reply,omitempty"`
+	LastReplyAt  time.Time `json:"last_replyat" bson:"last_replyat"`
+	Participants []string  `json:"participants,omitempty" bson:"participants,omitempty"`
+}
+
+func threadUnreadKey(rootID string) string {
+	return "thread:" + rootID + ":unread"
+}
+
+// Fetch the root of a thread, which must be a top-level message of the chat.
+func getThreadRoot(chatID, rootID string) (Message, error) {
+	root, err := getMessage(chatID, rootID)
+	if err != nil {
+		return root, err
+	}
+	if root.ThreadID != "" {
+		return root, mongo.ErrNoDocuments
+	}
+	return root, nil
+}
+
+// Update the root's summary after a reply and bump the other participants' unread counts.
+func recordThreadReply(root, reply Message) {
+	update := bson.M{
+		"$inc":      bson.M{"thread.reply_count": 1},
+		"$set":      bson.M{"thread.last_reply": newQuote(reply), "thread.last_replyat": reply.CreatedAt},
+		"$addToSet": bson.M{"thread.participants": bson.M{"$each": []string{root.Sender, reply.Sender}}},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var updated Message
+	err := messagesCollection.FindOneAndUpdate(ctx, bson.M{"message_id": root.MessageID}, update, opts).Decode(&updated)
+	if err != nil {
+		log.Println("Failed to update thread root:", root.MessageID, err)
+		return
+	}
+
+	for _, userID := range updated.Thread.Participants {
+		if userID != reply.Sender {
+			redisClient.HIncrBy(ctx, threadUnreadKey(root.MessageID), userID, 1)
+		}
+	}
+
+	wsMessage := struct {
+		Type    string         `json:"type"`
+		ChatID  string         `json:"chat_id"`
+		RootID  string         `json:"thread_id"`
+		Reply   Message        `json:"reply"`
+		Summary *ThreadSummary `json:"thread"`
+	}{
+		Type:    "thread_reply",
+		ChatID:  root.ChatID,
+		RootID:  root.MessageID,
+		Reply:   reply,
+		Summary: updated.Thread,
+	}
+	wsBroadcast(root.ChatID, wsMessage)
+}
+
+// Keep the reply count right when a reply is deleted, and if it was the last reply shown,
+// show the newest remaining one instead, or none.
+func recordThreadReplyDeleted(reply Message) {
+	if reply.ThreadID == "" {
+		return
+	}
+	filter := bson.M{"message_id": reply.ThreadID, "thread.reply_count": bson.M{"$gt": 0}}
+	if _, err := messagesCollection.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"thread.reply_count": -1}}); err != nil {
+		log.Println("Failed to update thread root:", reply.ThreadID, err)
+	}
+
+	update := bson.M{"$unset": bson.M{"thread.last_reply": "", "thread.last_replyat": ""}}
+	var last Message
+	opts := options.FindOne().SetSort(bson.D{{Key: "createdat", Value: -1}, {Key: "message_id", Value: -1}})
+	err := messagesCollection.FindOne(ctx, bson.M{"thread_id": reply.ThreadID, "deleted": false}, opts).Decode(&last)
+	if err == nil {
+		update = bson.M{"$set": bson.M{"thread.last_reply": newQuote(last), "thread.last_replyat": last.CreatedAt}}
+	} else if err != mongo.ErrNoDocuments {
+		log.Println("Failed to fetch thread replies:", reply.ThreadID, err)
+		return
+	}
+	// A reply sent meanwhile has replaced the deleted one already.
+	filter = bson.M{"message_id": reply.ThreadID, "thread.last_reply.message_id": reply.MessageID}
+	if _, err := messagesCollection.UpdateOne(ctx, filter, update); err != nil {
+		log.Println("Failed to update thread root:", reply.ThreadID, err)
+	}
+}
+
+// Fill in the user's unread reply count for each thread root.
+func setThreadUnread(msgs []Message, userID string) {
+	for i := range msgs {
+		if msgs[i].Thread == nil {
+			continue
+		}
+		n, err := redisClient.HGet(ctx, threadUnreadKey(msgs[i].MessageID), userID).Int()
+		if err == nil {
+			msgs[i].ThreadUnread = n
+		}
+	}
+}
+
+// --- Handlers ---
+
+// Page through the replies of a thread, oldest first. Pages are requested with
+// ?after=<next_cursor of the previous page>. Reading a thread clears its unread count.
+func threadHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	root, err := getMemberMessage(ps.ByName("id"), claims.UserID)
+	if err == mongo.ErrNoDocuments || root.ThreadID != "" {
+		http.Error(w, "Thread not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch thread", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	limit := int64(defaultThreadLimit)
+	if l, err := strconv.ParseInt(query.Get("limit"), 10, 64); err == nil && l > 0 {
+		limit = min(l, maxThreadLimit)
+	}
+
+	filter := bson.M{"chat_id": root.ChatID, "thread_id": root.MessageID, "deleted": false}
+	if after := query.Get("after"); after != "" {
+		createdAt, messageID, ok := decodeCursor(after)
+		if !ok {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		filter["$or"] = cursorFilter("createdat", "message_id", createdAt, messageID, true)["$or"]
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "createdat", Value: 1}, {Key: "message_id", Value: 1}}).SetLimit(limit)
+	cur, err := messagesCollection.Find(ctx, filter, opts)
+	if err != nil {
+		http.Error(w, "Failed to fetch thread", http.StatusInternalServerError)
+		return
+	}
+	replies := []Message{}
+	if err := cur.All(ctx, &replies); err != nil {
+		http.Error(w, "Failed to fetch thread", http.StatusInternalServerError)
+		return
+	}
+	for i := range replies {
+		replies[i].ReactionSummary = summarizeReactions(replies[i].Reactions, claims.UserID)
+	}
+	root.ReactionSummary = summarizeReactions(root.Reactions, claims.UserID)
+
+	redisClient.HDel(ctx, threadUnreadKey(root.MessageID), claims.UserID)
+
+	var nextCursor string
+	if int64(len(replies)) == limit {
+		last := replies[len(replies)-1]
+		nextCursor = encodeCursor(last.CreatedAt, last.MessageID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Root       Message   `json:"root"`
+		Replies    []Message `json:"replies"`
+		NextCursor string    `json:"next_cursor,omitempty"`
+	}{
+		Root:       root,
+		Replies:    replies,
+		NextCursor: nextCursor,
+	})
+}
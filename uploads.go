@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"log"
+	"net/http"
+	"nwr/utils"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Resumable uploads following the tus 1.0.0 protocol (https://tus.io/protocols/resumable-upload),
+// with the creation, expiration and termination extensions.
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+
+	partialUploadDir      = "./tmp/uploads"
+	maxUploadSize         = 2 << 30 // 2GB per upload
+	maxPendingUploadBytes = 4 << 30 // 4GB of unfinished uploads per user
+	uploadExpiry          = 24 * time.Hour
+)
+
+type Upload struct {
+	UploadID    string    `json:"upload_id" bson:"upload_id"`
+	UserID      string    `json:"user_id" bson:"user_id"`
+	Filename    string    `json:"filename" bson:"filename"`
+	ContentType string    `json:"content_type" bson:"content_type"`
+	Length      int64     `json:"length" bson:"length"`
+	Offset      int64     `json:"offset" bson:"offset"`
+	CreatedAt   time.Time `json:"createdat" bson:"createdat"`
+	ExpiresAt   time.Time `json:"expiresat" bson:"expiresat"`
+}
+
+// Uploads with a PATCH in progress; a second PATCH of the same upload is turned away.
+var (
+	uploadLocksMu sync.Mutex
+	uploadLocks   = make(map[string]bool)
+)
+
+func lockUpload(uploadID string) bool {
+	uploadLocksMu.Lock()
+	defer uploadLocksMu.Unlock()
+	if uploadLocks[uploadID] {
+		return false
+	}
+	uploadLocks[uploadID] = true
+	return true
+}
+
+func unlockUpload(uploadID string) {
+	uploadLocksMu.Lock()
+	delete(uploadLocks, uploadID)
+	uploadLocksMu.Unlock()
+}
+
+func (u Upload) path() string {
+	return filepath.Join(partialUploadDir, u.UploadID)
+}
+
+func (u Upload) complete() bool {
+	return u.Offset == u.Length
+}
+
+func setTusHeaders(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+}
+
+// Reject requests from clients speaking another version of the protocol.
+func checkTusVersion(w http.ResponseWriter, r *http.Request) bool {
+	setTusHeaders(w)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// Parse the Upload-Metadata header: comma-separated "key base64value" pairs.
+func parseUploadMetadata(header string) map[string]string {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			continue
+		}
+		meta[key] = string(value)
+	}
+	return meta
+}
+
+func getUpload(uploadID, userID string) (Upload, error) {
+	var up Upload
+	err := uploadsCollection.FindOne(ctx, bson.M{"upload_id": uploadID, "user_id": userID}).Decode(&up)
+	return up, err
+}
+
+// Bytes reserved by a user's uploads that have not been attached to a message yet.
+func pendingUploadBytes(userID string) (int64, error) {
+	cur, err := uploadsCollection.Find(ctx, bson.M{"user_id": userID})
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(ctx)
+
+	var total int64
+	for cur.Next(ctx) {
+		var up Upload
+		if err := cur.Decode(&up); err != nil {
+			log.Println("Decode upload error:", err)
+			continue
+		}
+		total += up.Length
+	}
+	return total, nil
+}
+
+func removeUpload(up Upload) error {
+	if err := os.Remove(up.path()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	_, err := uploadsCollection.DeleteOne(ctx, bson.M{"upload_id": up.UploadID})
+	return err
+}
+
+// --- Handlers ---
+
+// Advertise server capabilities.
+func tusOptionsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	setTusHeaders(w)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxUploadSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Create a new upload.
+func createUploadHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length > maxUploadSize {
+		http.Error(w, "Upload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	pending, err := pendingUploadBytes(claims.UserID)
+	if err != nil {
+		http.Error(w, "Failed to check upload quota", http.StatusInternalServerError)
+		return
+	}
+	if pending+length > maxPendingUploadBytes {
+		http.Error(w, "Upload quota exceeded", http.StatusRequestEntityTooLarge)
+		return
+	}
+	release, err := reserveStorageQuota(claims.UserID, "", length)
+	if err == errStorageQuota {
+		http.Error(w, "Storage quota exceeded", http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to check storage quota", http.StatusInternalServerError)
+		return
+	}
+	defer release() // Once recorded, the upload counts as pending.
+
+	meta := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	filename := filepath.Base(meta["filename"])
+	if filename == "." || filename == "/" {
+		filename = ""
+	}
+
+	now := time.Now()
+	up := Upload{
+		UploadID:    utils.GenerateStringName(24),
+		UserID:      claims.UserID,
+		Filename:    filename,
+		ContentType: meta["filetype"],
+		Length:      length,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(uploadExpiry),
+	}
+
+	if err := ensureDir(partialUploadDir); err != nil {
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	f, err := os.Create(up.path())
+	if err != nil {
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+
+	if _, err := uploadsCollection.InsertOne(ctx, up); err != nil {
+		os.Remove(up.path())
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/api/uploads/"+up.UploadID)
+	w.Header().Set("Upload-Expires", up.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Report how much of an upload the server has received.
+func headUploadHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	up, err := getUpload(ps.ByName("id"), claims.UserID)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch upload", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(up.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(up.Length, 10))
+	w.Header().Set("Upload-Expires", up.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// Append a chunk to an upload.
+func patchUploadHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Invalid Content-Type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// Lock before reading the offset, so the offset checked is the one written at.
+	if !lockUpload(ps.ByName("id")) {
+		http.Error(w, "Upload is being written to by another request", http.StatusLocked)
+		return
+	}
+	defer unlockUpload(ps.ByName("id"))
+
+	up, err := getUpload(ps.ByName("id"), claims.UserID)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch upload", http.StatusInternalServerError)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != up.Offset {
+		http.Error(w, "Upload-Offset mismatch", http.StatusConflict)
+		return
+	}
+
+	f, err := os.OpenFile(up.path(), os.O_WRONLY, 0644)
+	if err != nil {
+		http.Error(w, "Failed to open upload", http.StatusInternalServerError)
+		return
+	}
+	// Drop bytes past the recorded offset, left by a write whose offset was never recorded.
+	if err := f.Truncate(up.Offset); err != nil {
+		f.Close()
+		http.Error(w, "Failed to prepare upload", http.StatusInternalServerError)
+		return
+	}
+	// Keep whatever arrived even if the connection drops, so the client can resume from there.
+	n, copyErr := io.Copy(io.NewOffsetWriter(f, up.Offset), io.LimitReader(r.Body, up.Length-up.Offset))
+	f.Close()
+
+	// Only advance from the offset written at; another server may have moved it meanwhile.
+	previous := up.Offset
+	up.Offset += n
+	up.ExpiresAt = time.Now().Add(uploadExpiry)
+	res, err := uploadsCollection.UpdateOne(ctx, bson.M{"upload_id": up.UploadID, "offset": previous},
+		bson.M{"$set": bson.M{"offset": up.Offset, "expiresat": up.ExpiresAt}})
+	if err != nil {
+		http.Error(w, "Failed to update upload", http.StatusInternalServerError)
+		return
+	}
+	if res.MatchedCount == 0 {
+		http.Error(w, "Upload-Offset mismatch", http.StatusConflict)
+		return
+	}
+	if copyErr != nil {
+		log.Println("Upload interrupted:", up.UploadID, copyErr)
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(up.Offset, 10))
+	w.Header().Set("Upload-Expires", up.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Abort an upload and discard its data.
+func deleteUploadHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	up, err := getUpload(ps.ByName("id"), claims.UserID)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch upload", http.StatusInternalServerError)
+		return
+	}
+
+	if err := removeUpload(up); err != nil {
+		http.Error(w, "Failed to delete upload", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Periodically remove uploads that were abandoned or never attached to a message.
+func expireUploads() {
+	ticker := time.NewTicker(10 * time.Minute)
+	for range ticker.C {
+		cur, err := uploadsCollection.Find(ctx, bson.M{"expiresat": bson.M{"$lt": time.Now()}})
+		if err != nil {
+			log.Println("Expired uploads query error:", err)
+			continue
+		}
+		var expired []Upload
+		if err := cur.All(ctx, &expired); err != nil {
+			log.Println("Decode upload error:", err)
+		}
+		for _, up := range expired {
+			if err := removeUpload(up); err != nil {
+				log.Println("Failed to remove expired upload:", up.UploadID, err)
+			}
+		}
+	}
+}
+
+// Generic function to ensure directory existence
+func ensureDir(dir string) error {
+	return os.MkdirAll(dir, 0755)
+}
@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Images are shrunk to this size before hashing; a BlurHash only keeps a
+// handful of low-frequency components, so more pixels add nothing but time.
+const blurHashSampleSize = 32
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// ImagePlaceholder opens the image at path (the first frame, for GIFs) and
+// returns its BlurHash and dominant color as a "#rrggbb" string.
+func ImagePlaceholder(path string) (string, string, error) {
+	img, err := imaging.Open(path, imaging.AutoOrientation(true))
+	if err != nil {
+		return "", "", err
+	}
+	small := imaging.Fit(img, blurHashSampleSize, blurHashSampleSize, imaging.Box)
+
+	hash, err := BlurHash(small, 4, 3)
+	if err != nil {
+		return "", "", err
+	}
+	return hash, DominantColor(small), nil
+}
+
+// DominantColor returns the average color of img as a "#rrggbb" string.
+func DominantColor(img image.Image) string {
+	c := imaging.Resize(img, 1, 1, imaging.Box).NRGBAAt(0, 0)
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// BlurHash encodes img with the given number of horizontal and vertical
+// components (1-9 each), following https://github.com/woltapp/blurhash.
+func BlurHash(img image.Image, xComponents, yComponents int) (string, error) {
+	if xComponents < 1 || xComponents > 9 || yComponents < 1 || yComponents > 9 {
+		return "", fmt.Errorf("blurhash components must be between 1 and 9")
+	}
+	src := imaging.Clone(img)
+	width, height := src.Bounds().Dx(), src.Bounds().Dy()
+	if width == 0 || height == 0 {
+		return "", fmt.Errorf("empty image")
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1.0
+			}
+			var r, g, b float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := normalisation *
+						math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(height))
+					c := src.NRGBAAt(x, y)
+					r += basis * sRGBToLinear(c.R)
+					g += basis * sRGBToLinear(c.G)
+					b += basis * sRGBToLinear(c.B)
+				}
+			}
+			scale := 1.0 / float64(width*height)
+			factors = append(factors, [3]float64{r * scale, g * scale, b * scale})
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(encode83((xComponents-1)+(yComponents-1)*9, 1))
+
+	dc, ac := factors[0], factors[1:]
+	maximumValue := 1.0
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			actualMax = math.Max(actualMax, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maximumValue = float64(quantisedMax+1) / 166
+		sb.WriteString(encode83(quantisedMax, 1))
+	} else {
+		sb.WriteString(encode83(0, 1))
+	}
+
+	sb.WriteString(encode83((linearToSRGB(dc[0])<<16)+(linearToSRGB(dc[1])<<8)+linearToSRGB(dc[2]), 4))
+	for _, f := range ac {
+		sb.WriteString(encode83(encodeAC(f, maximumValue), 2))
+	}
+	return sb.String(), nil
+}
+
+func encodeAC(f [3]float64, maximumValue float64) int {
+	quant := func(v float64) int {
+		return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maximumValue, 0.5)*9+9.5))))
+	}
+	return quant(f[0])*19*19 + quant(f[1])*19 + quant(f[2])
+}
+
+func encode83(value, length int) string {
+	b := make([]byte, length)
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		b[i-1] = base83Chars[digit]
+	}
+	return string(b)
+}
+
+func sRGBToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// EnvBool parses the environment variable key as a bool, or returns fallback if it is unset or invalid.
+func EnvBool(key string, fallback bool) bool {
+	v, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+// EnvList splits the environment variable key on commas, dropping empty entries.
+func EnvList(key string) []string {
+	var list []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// EnvInt64 parses the environment variable key as an int64, or returns fallback if it is unset or invalid.
+func EnvInt64(key string, fallback int64) int64 {
+	v, err := strconv.ParseInt(os.Getenv(key), 10, 64)
+	if err != nil {
+		return fallback
+	}
+	return v
+}
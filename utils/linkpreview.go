@@ -0,0 +1,314 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// LinkMetadata is what a web page says about itself in its OpenGraph and Twitter card
+// tags, falling back to its <title> and description meta tag.
+type LinkMetadata struct {
+	URL         string // After redirects.
+	Title       string
+	Description string
+	SiteName    string
+	ImageURL    string
+}
+
+// FetcherOptions configures a LinkFetcher. Zero values get the defaults.
+type FetcherOptions struct {
+	Timeout       time.Duration // For a whole request, redirects included. Default 5s.
+	MaxPageBytes  int64         // Of the page read for its tags. Default 512KB.
+	MaxImageBytes int64         // Default 5MB.
+	MaxRedirects  int           // Default 5.
+	UserAgent     string
+	// AllowAddress decides which addresses may be connected to. The default allows public
+	// addresses on ports 80 and 443 only; tests against an httptest server can allow more.
+	AllowAddress func(ip net.IP, port int) bool
+}
+
+// LinkFetcher fetches web pages and images on behalf of users. It only connects to the
+// addresses AllowAddress allows, checked on the address actually dialed, so neither a
+// redirect nor a DNS answer can point it at the internal network.
+type LinkFetcher struct {
+	opts   FetcherOptions
+	client *http.Client
+}
+
+var (
+	ErrBlockedAddress   = errors.New("address not allowed")
+	ErrUnsupportedURL   = errors.New("only http and https URLs can be fetched")
+	ErrTooLarge         = errors.New("response too large")
+	ErrUnexpectedType   = errors.New("unexpected content type")
+	errTooManyRedirects = errors.New("too many redirects")
+)
+
+// Ranges that IsPublicIP rejects besides the ones net.IP knows about.
+var nonPublicNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",       // "This" network.
+		"100.64.0.0/10",   // Carrier-grade NAT.
+		"192.0.0.0/24",    // IETF protocol assignments.
+		"192.0.2.0/24",    // Documentation.
+		"198.18.0.0/15",   // Benchmarking.
+		"198.51.100.0/24", // Documentation.
+		"203.0.113.0/24",  // Documentation.
+		"240.0.0.0/4",     // Reserved, and broadcast.
+		"64:ff9b::/96",    // NAT64, which can reach IPv4 addresses of any kind.
+		"2001:db8::/32",   // Documentation.
+	} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// IsPublicIP reports whether ip is a globally routable unicast address.
+func IsPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func allowPublicWeb(ip net.IP, port int) bool {
+	return (port == 80 || port == 443) && IsPublicIP(ip)
+}
+
+// NewLinkFetcher returns a fetcher with the given options.
+func NewLinkFetcher(opts FetcherOptions) *LinkFetcher {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if opts.MaxPageBytes <= 0 {
+		opts.MaxPageBytes = 512 << 10
+	}
+	if opts.MaxImageBytes <= 0 {
+		opts.MaxImageBytes = 5 << 20
+	}
+	if opts.MaxRedirects <= 0 {
+		opts.MaxRedirects = 5
+	}
+	if opts.AllowAddress == nil {
+		opts.AllowAddress = allowPublicWeb
+	}
+
+	dialer := &net.Dialer{
+		Timeout: opts.Timeout,
+		// Runs after name resolution, on each address about to be connected to.
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, portStr, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			port, err := strconv.Atoi(portStr)
+			ip := net.ParseIP(host)
+			if err != nil || ip == nil || !opts.AllowAddress(ip, port) {
+				return fmt.Errorf("%w: %s", ErrBlockedAddress, address)
+			}
+			return nil
+		},
+	}
+	transport := &http.Transport{
+		Proxy:                  nil, // A proxy would make the address check meaningless.
+		DialContext:            dialer.DialContext,
+		TLSHandshakeTimeout:    opts.Timeout,
+		ResponseHeaderTimeout:  opts.Timeout,
+		MaxResponseHeaderBytes: 64 << 10,
+		MaxIdleConns:           16,
+		IdleConnTimeout:        30 * time.Second,
+	}
+
+	f := &LinkFetcher{opts: opts}
+	f.client = &http.Client{
+		Transport: transport,
+		Timeout:   opts.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > opts.MaxRedirects {
+				return errTooManyRedirects
+			}
+			return checkFetchURL(req.URL)
+		},
+	}
+	return f
+}
+
+func checkFetchURL(u *url.URL) error {
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return ErrUnsupportedURL
+	}
+	return nil
+}
+
+// get requests rawURL and checks the response has a status of 200 and one of the types.
+func (f *LinkFetcher) get(ctx context.Context, rawURL, accept string, types func(string) bool) (*http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkFetchURL(u); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+	if f.opts.UserAgent != "" {
+		req.Header.Set("User-Agent", f.opts.UserAgent)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !types(mediaType) {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %q", ErrUnexpectedType, mediaType)
+	}
+	return resp, nil
+}
+
+// FetchMetadata fetches the page at rawURL and reads its preview tags. Only the first
+// MaxPageBytes of the page are read, which is plenty for its <head>.
+func (f *LinkFetcher) FetchMetadata(ctx context.Context, rawURL string) (*LinkMetadata, error) {
+	resp, err := f.get(ctx, rawURL, "text/html,application/xhtml+xml", func(t string) bool {
+		return t == "text/html" || t == "application/xhtml+xml"
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	page, err := io.ReadAll(io.LimitReader(resp.Body, f.opts.MaxPageBytes))
+	if err != nil {
+		return nil, err
+	}
+	return ParseLinkMetadata(string(page), resp.Request.URL), nil
+}
+
+// FetchImage fetches the image at rawURL, failing if it is larger than MaxImageBytes.
+// Returns its data and content type.
+func (f *LinkFetcher) FetchImage(ctx context.Context, rawURL string) ([]byte, string, error) {
+	resp, err := f.get(ctx, rawURL, "image/*", func(t string) bool {
+		return strings.HasPrefix(t, "image/") && t != "image/svg+xml"
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.ContentLength > f.opts.MaxImageBytes {
+		return nil, "", ErrTooLarge
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, f.opts.MaxImageBytes+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > f.opts.MaxImageBytes {
+		return nil, "", ErrTooLarge
+	}
+	return data, http.DetectContentType(data), nil
+}
+
+var (
+	metaTagPattern  = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	attrPattern     = regexp.MustCompile(`(?is)([a-z][a-z0-9_:.-]*)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+	titleTagPattern = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+)
+
+// Longest title and description kept, in characters.
+const (
+	maxPreviewTitle       = 300
+	maxPreviewDescription = 1000
+)
+
+// ParseLinkMetadata reads the preview tags of an HTML page fetched from base. The first
+// of the OpenGraph, Twitter card and plain HTML values found wins.
+func ParseLinkMetadata(page string, base *url.URL) *LinkMetadata {
+	if end := strings.Index(strings.ToLower(page), "</head>"); end >= 0 {
+		page = page[:end]
+	}
+
+	tags := make(map[string]string)
+	for _, tag := range metaTagPattern.FindAllString(page, -1) {
+		attrs := make(map[string]string)
+		for _, m := range attrPattern.FindAllStringSubmatch(tag[len("<meta"):], -1) {
+			attrs[strings.ToLower(m[1])] = m[2] + m[3] + m[4]
+		}
+		key := attrs["property"]
+		if key == "" {
+			key = attrs["name"]
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		if _, seen := tags[key]; key != "" && !seen {
+			tags[key] = cleanTagValue(attrs["content"])
+		}
+	}
+	first := func(keys ...string) string {
+		for _, k := range keys {
+			if v := tags[k]; v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+
+	meta := &LinkMetadata{
+		URL:         base.String(),
+		Title:       first("og:title", "twitter:title"),
+		Description: first("og:description", "twitter:description", "description"),
+		SiteName:    first("og:site_name"),
+	}
+	if meta.Title == "" {
+		if m := titleTagPattern.FindStringSubmatch(page); m != nil {
+			meta.Title = cleanTagValue(m[1])
+		}
+	}
+	meta.Title = truncateRunes(meta.Title, maxPreviewTitle)
+	meta.Description = truncateRunes(meta.Description, maxPreviewDescription)
+
+	if img := first("og:image:secure_url", "og:image", "og:image:url", "twitter:image", "twitter:image:src"); img != "" {
+		if u, err := base.Parse(img); err == nil && checkFetchURL(u) == nil {
+			meta.ImageURL = u.String()
+		}
+	}
+	return meta
+}
+
+func cleanTagValue(v string) string {
+	return strings.Join(strings.Fields(html.UnescapeString(v)), " ")
+}
+
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n-1]) + "…"
+}
@@ -0,0 +1,155 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"net/http"
+
+	"github.com/disintegration/imaging"
+	_ "golang.org/x/image/webp" // Lets imaging decode WebP.
+)
+
+// MaxImagePixels is the most pixels an image may have to be decoded, so that a
+// small file declaring a huge canvas can't exhaust memory.
+const MaxImagePixels = 50_000_000
+
+var ErrImageTooLarge = errors.New("image dimensions too large")
+
+// CheckImagePixels reads the dimensions in an image's header and fails if the
+// image isn't one that can be decoded or has more than maxPixels pixels.
+func CheckImagePixels(data []byte, maxPixels int) error {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || int64(cfg.Width)*int64(cfg.Height) > int64(maxPixels) {
+		return ErrImageTooLarge
+	}
+	return nil
+}
+
+// StripImageMetadata returns a copy of a JPEG, PNG or WebP image without its
+// EXIF/XMP metadata. JPEG and PNG images are re-encoded, with the EXIF
+// orientation applied to the pixels first so the picture still displays the
+// right way up. WebP images, which imaging can read but not write, are
+// converted: to PNG when they have transparency, to JPEG otherwise; see
+// ImageExtension for naming the result. Their orientation is applied too.
+// Any other data is returned unchanged.
+func StripImageMetadata(data []byte) ([]byte, error) {
+	var format imaging.Format
+	orientation := 0
+	switch http.DetectContentType(data) {
+	case "image/jpeg":
+		format = imaging.JPEG
+	case "image/png":
+		format = imaging.PNG
+	case "image/webp":
+		format = imaging.JPEG               // Or PNG, once decoded, if it isn't opaque.
+		orientation = webpOrientation(data) // imaging only reads it from JPEG.
+	default:
+		return data, nil
+	}
+
+	img, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, err
+	}
+	img = applyOrientation(img, orientation)
+	if o, ok := img.(interface{ Opaque() bool }); ok && format == imaging.JPEG && !o.Opaque() {
+		format = imaging.PNG
+	}
+
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, img, format, imaging.JPEGQuality(90)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ImageExtension returns the file extension of JPEG and PNG data, or "" for
+// anything else.
+func ImageExtension(data []byte) string {
+	switch http.DetectContentType(data) {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	}
+	return ""
+}
+
+// webpOrientation returns the EXIF orientation of a WebP image, or 0 if it has none.
+func webpOrientation(data []byte) int {
+	for pos := 12; pos+8 <= len(data); {
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		if size > len(data)-pos-8 {
+			return 0
+		}
+		if string(data[pos:pos+4]) == "EXIF" {
+			return exifOrientation(data[pos+8 : pos+8+size])
+		}
+		pos += 8 + size + size%2 // Chunks are padded to an even size.
+	}
+	return 0
+}
+
+// exifOrientation reads the orientation tag of IFD0 from EXIF data (a TIFF
+// structure, sometimes still behind the "Exif\0\0" header JPEG puts before it).
+func exifOrientation(exif []byte) int {
+	exif = bytes.TrimPrefix(exif, []byte("Exif\x00\x00"))
+	if len(exif) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(exif[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	ifd := int(order.Uint32(exif[4:8]))
+	if ifd < 8 || ifd+2 > len(exif) {
+		return 0
+	}
+	entries := int(order.Uint16(exif[ifd : ifd+2]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(exif) {
+			return 0
+		}
+		if order.Uint16(exif[entry:entry+2]) == 0x0112 { // Orientation, a SHORT.
+			if o := int(order.Uint16(exif[entry+8 : entry+10])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// applyOrientation turns an image stored with the given EXIF orientation the
+// right way up.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	}
+	return img
+}
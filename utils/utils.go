@@ -112,11 +112,10 @@ func CreateThumb(filename string, fileLocation string, fileType string, thumbWid
 	outputPath := fmt.Sprintf("%s/thumb/%s%s", fileLocation, filename, fileType)
 
 	// Ensure directory exists
-	if err := ensureDir(fileLocation); err != nil {
-		log.Println("failed to create upload directory: %w", err)
+	if err := ensureDir(fileLocation + "/thumb"); err != nil {
+		log.Printf("failed to create thumb directory: %v", err)
 	}
 
-	fmt.Println(outputPath)
 	// thumbWidth := 300
 	// thumbHeight := 200
 	bgColor := color.White // Change to color.Transparent for a transparent background
@@ -151,6 +150,42 @@ func CreateThumb(filename string, fileLocation string, fileType string, thumbWid
 	return imaging.Save(thumbImg, outputPath)
 }
 
+// CreateRendition writes a copy of the image scaled to fit within maxWidth x maxHeight
+// to fileLocation/<name>/ and returns the dimensions of the written image.
+func CreateRendition(filename string, fileLocation string, fileType string, name string, maxWidth int, maxHeight int) (int, int, error) {
+	inputPath := fmt.Sprintf("%s/%s%s", fileLocation, filename, fileType)
+	outputPath := fmt.Sprintf("%s/%s/%s%s", fileLocation, name, filename, fileType)
+
+	if err := ensureDir(fileLocation + "/" + name); err != nil {
+		return 0, 0, err
+	}
+
+	img, err := imaging.Open(inputPath)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	newWidth, newHeight := fitResolution(img.Bounds().Dx(), img.Bounds().Dy(), maxWidth, maxHeight)
+	resizedImg := imaging.Resize(img, newWidth, newHeight, imaging.Lanczos)
+
+	return newWidth, newHeight, imaging.Save(resizedImg, outputPath)
+}
+
+// ImageSize returns the width and height of the image at path.
+func ImageSize(path string) (int, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
 func fitResolution(origWidth, origHeight, maxWidth, maxHeight int) (int, int) {
 	// If the original image is already smaller than the target size, keep it unchanged
 	if origWidth <= maxWidth && origHeight <= maxHeight {
@@ -0,0 +1,244 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// VCard holds the fields of a vCard (RFC 2426 / RFC 6350) that contacts use.
+type VCard struct {
+	Version      string
+	Name         string // FN, or built from N when FN is missing.
+	Phones       []string
+	Emails       []string
+	Organization string
+	Note         string
+}
+
+// Lines longer than this are folded when writing, as both versions recommend.
+const vcardLineLength = 75
+
+// ParseVCards reads every vCard in r. Only versions 3.0 and 4.0 are accepted;
+// properties other than the ones in VCard are ignored.
+func ParseVCards(r io.Reader) ([]VCard, error) {
+	lines, err := unfoldVCardLines(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var cards []VCard
+	var card *VCard
+	var structuredName string
+	for n, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		name, value, ok := splitVCardLine(line)
+		if !ok {
+			return nil, fmt.Errorf("vcard: line %d: malformed property", n+1)
+		}
+
+		switch {
+		case name == "BEGIN" && strings.EqualFold(value, "VCARD"):
+			if card != nil {
+				return nil, fmt.Errorf("vcard: line %d: nested BEGIN:VCARD", n+1)
+			}
+			card, structuredName = &VCard{}, ""
+			continue
+		case card == nil:
+			return nil, fmt.Errorf("vcard: line %d: property outside BEGIN:VCARD", n+1)
+		}
+
+		switch name {
+		case "END":
+			if card.Version != "3.0" && card.Version != "4.0" {
+				return nil, fmt.Errorf("vcard: unsupported version %q", card.Version)
+			}
+			if card.Name == "" {
+				card.Name = structuredName
+			}
+			if card.Name == "" {
+				return nil, errors.New("vcard: card without a name")
+			}
+			cards = append(cards, *card)
+			card = nil
+		case "VERSION":
+			card.Version = value
+		case "FN":
+			card.Name = unescapeVCardText(value)
+		case "N":
+			structuredName = nameFromN(value)
+		case "TEL":
+			// 4.0 cards usually give the number as a tel: URI.
+			if tel := strings.TrimPrefix(value, "tel:"); tel != "" {
+				card.Phones = append(card.Phones, unescapeVCardText(tel))
+			}
+		case "EMAIL":
+			if value != "" {
+				card.Emails = append(card.Emails, unescapeVCardText(value))
+			}
+		case "ORG":
+			card.Organization = strings.TrimSpace(strings.Join(splitVCardValue(value, ';'), " "))
+		case "NOTE":
+			card.Note = unescapeVCardText(value)
+		}
+	}
+	if card != nil {
+		return nil, errors.New("vcard: missing END:VCARD")
+	}
+	return cards, nil
+}
+
+// WriteVCard writes c as a vCard of the given version ("3.0" or "4.0").
+func WriteVCard(w io.Writer, c VCard, version string) error {
+	if version != "3.0" && version != "4.0" {
+		return fmt.Errorf("vcard: unsupported version %q", version)
+	}
+
+	props := []string{"BEGIN:VCARD", "VERSION:" + version, "FN:" + escapeVCardText(c.Name)}
+	// N is required in 3.0; put the whole name in the family-name component.
+	props = append(props, "N:"+escapeVCardText(c.Name)+";;;;")
+	for _, p := range c.Phones {
+		if version == "4.0" {
+			props = append(props, "TEL;VALUE=uri:tel:"+strings.ReplaceAll(p, " ", "-"))
+		} else {
+			props = append(props, "TEL:"+escapeVCardText(p))
+		}
+	}
+	for _, e := range c.Emails {
+		props = append(props, "EMAIL:"+escapeVCardText(e))
+	}
+	if c.Organization != "" {
+		props = append(props, "ORG:"+escapeVCardText(c.Organization))
+	}
+	if c.Note != "" {
+		props = append(props, "NOTE:"+escapeVCardText(c.Note))
+	}
+	props = append(props, "END:VCARD")
+
+	for _, p := range props {
+		if _, err := io.WriteString(w, foldVCardLine(p)+"\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Join continuation lines (starting with a space or tab) onto the line before them.
+func unfoldVCardLines(r io.Reader) ([]string, error) {
+	var lines []string
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, sc.Err()
+}
+
+// Split "group.NAME;PARAM=a;TYPE=b:value" into its upper-cased name and value.
+// Parameters are not needed by any of the properties VCard keeps.
+func splitVCardLine(line string) (string, string, bool) {
+	// The value may contain colons; the name and parameters can only contain them quoted.
+	colon, quoted := -1, false
+	for i, r := range line {
+		if r == '"' {
+			quoted = !quoted
+		} else if r == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon <= 0 {
+		return "", "", false
+	}
+
+	name, _, _ := strings.Cut(line[:colon], ";")
+	name = strings.ToUpper(name)
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	return name, line[colon+1:], name != ""
+}
+
+// Build a display name from N: family;given;additional;prefixes;suffixes.
+func nameFromN(value string) string {
+	c := splitVCardValue(value, ';')
+	for len(c) < 5 {
+		c = append(c, "")
+	}
+	var parts []string
+	for _, p := range []string{c[3], c[1], c[2], c[0], c[4]} {
+		if p = strings.TrimSpace(p); p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// Split a structured value on unescaped separators and unescape each component.
+func splitVCardValue(value string, sep byte) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' {
+			i++
+			continue
+		}
+		if value[i] == sep {
+			parts = append(parts, unescapeVCardText(value[start:i]))
+			start = i + 1
+		}
+	}
+	return append(parts, unescapeVCardText(value[start:]))
+}
+
+func unescapeVCardText(s string) string {
+	if !strings.Contains(s, `\`) {
+		return strings.TrimSpace(s)
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+			if s[i] == 'n' || s[i] == 'N' {
+				b.WriteByte('\n')
+			} else {
+				b.WriteByte(s[i])
+			}
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return strings.TrimSpace(b.String())
+}
+
+func escapeVCardText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", "", ";", `\;`, ",", `\,`).Replace(s)
+}
+
+// Fold a line at vcardLineLength octets without splitting UTF-8 sequences.
+func foldVCardLine(line string) string {
+	if len(line) <= vcardLineLength {
+		return line
+	}
+	var b strings.Builder
+	width := 0
+	for _, r := range line {
+		size := len(string(r))
+		if width+size > vcardLineLength {
+			b.WriteString("\r\n ")
+			width = 1
+		}
+		b.WriteRune(r)
+		width += size
+	}
+	return b.String()
+}
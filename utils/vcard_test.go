@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVCardRoundTrip(t *testing.T) {
+	cards := []VCard{
+		{Name: "Ada Lovelace", Phones: []string{"+44 20 7946 0958"}, Emails: []string{"ada@example.org"}, Organization: "Analytical Engines"},
+		{Name: "Escapes; commas, and \\ backslashes", Note: "two\nlines", Organization: "A; B, C"},
+		{Name: "Zoë Ünicode " + strings.Repeat("ü", 60), Emails: []string{"a@example.org", "b@example.org"}},
+		{Name: "No Details"},
+	}
+
+	for _, version := range []string{"3.0", "4.0"} {
+		var buf bytes.Buffer
+		for _, c := range cards {
+			if err := WriteVCard(&buf, c, version); err != nil {
+				t.Fatalf("WriteVCard %s: %v", version, err)
+			}
+		}
+		for _, line := range strings.Split(buf.String(), "\r\n") {
+			if len(line) > vcardLineLength {
+				t.Errorf("%s: line not folded (%d octets): %q", version, len(line), line)
+			}
+		}
+
+		parsed, err := ParseVCards(&buf)
+		if err != nil {
+			t.Fatalf("ParseVCards %s: %v", version, err)
+		}
+		if len(parsed) != len(cards) {
+			t.Fatalf("%s: got %d cards, want %d", version, len(parsed), len(cards))
+		}
+		for i, want := range cards {
+			want.Version = version
+			if version == "4.0" {
+				// Phone numbers are written as tel: URIs, with dashes for spaces.
+				var phones []string
+				for _, p := range want.Phones {
+					phones = append(phones, strings.ReplaceAll(p, " ", "-"))
+				}
+				want.Phones = phones
+			}
+			if !reflect.DeepEqual(parsed[i], want) {
+				t.Errorf("%s: card %d:\n got  %#v\n want %#v", version, i, parsed[i], want)
+			}
+		}
+	}
+}
+
+func TestParseVCards(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []VCard
+	}{
+		{
+			name: "name from N, grouped and folded properties",
+			input: "BEGIN:VCARD\r\nVERSION:3.0\r\nN:Doe;Jane;;Dr.;\r\nitem1.EMAIL;TYPE=INTERNET:jane@exam\r\n ple.org\r\n" +
+				"TEL;TYPE=CELL:+1 555 0100\r\nEND:VCARD\r\n",
+			want: []VCard{{Version: "3.0", Name: "Dr. Jane Doe", Phones: []string{"+1 555 0100"}, Emails: []string{"jane@example.org"}}},
+		},
+		{
+			name:  "4.0 tel URI and LF line endings",
+			input: "BEGIN:VCARD\nVERSION:4.0\nFN:Sam\nTEL;VALUE=uri;TYPE=voice:tel:+1-555-0101\nEND:VCARD\n",
+			want:  []VCard{{Version: "4.0", Name: "Sam", Phones: []string{"+1-555-0101"}}},
+		},
+	}
+	for _, tt := range tests {
+		got, err := ParseVCards(strings.NewReader(tt.input))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s:\n got  %#v\n want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseVCardsErrors(t *testing.T) {
+	for _, input := range []string{
+		"BEGIN:VCARD\r\nVERSION:2.1\r\nFN:Old\r\nEND:VCARD\r\n",
+		"BEGIN:VCARD\r\nVERSION:3.0\r\nFN:Open\r\n",
+		"BEGIN:VCARD\r\nVERSION:3.0\r\nEND:VCARD\r\n",
+		"FN:Outside\r\n",
+		"BEGIN:VCARD\r\nVERSION:3.0\r\nBEGIN:VCARD\r\n",
+	} {
+		if _, err := ParseVCards(strings.NewReader(input)); err == nil {
+			t.Errorf("ParseVCards(%q): expected an error", input)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// WAV format codes.
+const (
+	wavFormatPCM        = 1
+	wavFormatFloat      = 3
+	wavFormatExtensible = 0xFFFE
+)
+
+// WaveformMax is the largest value of a waveform sample.
+const WaveformMax = 100
+
+var (
+	errInvalidWAV = errors.New("not a valid WAV file")
+	// ErrUnsupportedWAV is returned for WAV files holding audio other than PCM or floating
+	// point, such as ADPCM, which can't be analyzed.
+	ErrUnsupportedWAV = errors.New("unsupported WAV codec")
+)
+
+// IsWAV reports whether data starts like a RIFF WAVE file.
+func IsWAV(data []byte) bool {
+	return len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WAVE"
+}
+
+// AnalyzeWAV returns the duration in seconds of PCM or floating-point WAV audio and its
+// waveform: the loudness of n equal slices of it, from 0 to WaveformMax, scaled so the
+// loudest slice is WaveformMax. Other codecs get ErrUnsupportedWAV.
+func AnalyzeWAV(data []byte, n int) (float64, []int, error) {
+	if !IsWAV(data) || n <= 0 {
+		return 0, nil, errInvalidWAV
+	}
+
+	var format, channels, bits, blockAlign int
+	var sampleRate int
+	var samples []byte
+	for p := 12; p+8 <= len(data); {
+		id := string(data[p : p+4])
+		size := int(binary.LittleEndian.Uint32(data[p+4 : p+8]))
+		body := data[p+8:]
+		if size > len(body) {
+			size = len(body) // Recorders that were cut off leave the size unset or too large.
+		}
+		body = body[:size]
+
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return 0, nil, errInvalidWAV
+			}
+			format = int(binary.LittleEndian.Uint16(body[0:2]))
+			channels = int(binary.LittleEndian.Uint16(body[2:4]))
+			sampleRate = int(binary.LittleEndian.Uint32(body[4:8]))
+			blockAlign = int(binary.LittleEndian.Uint16(body[12:14]))
+			bits = int(binary.LittleEndian.Uint16(body[14:16]))
+			if format == wavFormatExtensible && size >= 26 {
+				format = int(binary.LittleEndian.Uint16(body[24:26])) // The sub-format GUID starts with the code.
+			}
+		case "data":
+			samples = body
+		}
+		p += 8 + size + size%2 // Chunks are padded to an even size.
+	}
+
+	if channels <= 0 || sampleRate <= 0 || samples == nil {
+		return 0, nil, errInvalidWAV
+	}
+	var sample func(b []byte) float64
+	switch {
+	case format == wavFormatPCM && bits == 8:
+		sample = func(b []byte) float64 { return (float64(b[0]) - 128) / 128 }
+	case format == wavFormatPCM && bits == 16:
+		sample = func(b []byte) float64 { return float64(int16(binary.LittleEndian.Uint16(b))) / (1 << 15) }
+	case format == wavFormatPCM && bits == 24:
+		sample = func(b []byte) float64 {
+			return float64(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24)>>8) / (1 << 23)
+		}
+	case format == wavFormatPCM && bits == 32:
+		sample = func(b []byte) float64 { return float64(int32(binary.LittleEndian.Uint32(b))) / (1 << 31) }
+	case format == wavFormatFloat && bits == 32:
+		sample = func(b []byte) float64 { return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))) }
+	default:
+		return 0, nil, ErrUnsupportedWAV
+	}
+	bytesPerSample := bits / 8
+	if blockAlign != channels*bytesPerSample {
+		return 0, nil, errInvalidWAV
+	}
+
+	frames := len(samples) / blockAlign
+	duration := float64(frames) / float64(sampleRate)
+
+	// Root mean square of each slice, over all channels.
+	levels := make([]float64, n)
+	loudest := 0.0
+	for i := range levels {
+		from, to := frames*i/n, frames*(i+1)/n
+		sum, count := 0.0, 0
+		for f := from; f < to; f++ {
+			frame := samples[f*blockAlign : (f+1)*blockAlign]
+			for c := 0; c < channels; c++ {
+				v := sample(frame[c*bytesPerSample:])
+				if math.IsNaN(v) || math.IsInf(v, 0) {
+					continue
+				}
+				sum += v * v
+				count++
+			}
+		}
+		if count > 0 {
+			levels[i] = math.Sqrt(sum / float64(count))
+		}
+		loudest = math.Max(loudest, levels[i])
+	}
+
+	waveform := make([]int, n)
+	for i, l := range levels {
+		if loudest > 0 {
+			waveform[i] = int(math.Round(l / loudest * WaveformMax))
+		}
+	}
+	return duration, waveform, nil
+}
+
+// DownsampleWaveform reduces a waveform to n samples, keeping the peak of each slice.
+// Waveforms of n samples or fewer are returned unchanged.
+func DownsampleWaveform(waveform []int, n int) []int {
+	if len(waveform) <= n {
+		return waveform
+	}
+	out := make([]int, n)
+	for i := range out {
+		from, to := len(waveform)*i/n, len(waveform)*(i+1)/n
+		for _, v := range waveform[from:to] {
+			if v > out[i] {
+				out[i] = v
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,180 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// makeWAV builds a WAV file with a fmt chunk of the given format and a data chunk.
+func makeWAV(format, channels, sampleRate, bits int, data []byte) []byte {
+	le := binary.LittleEndian
+	blockAlign := channels * bits / 8
+	fmtChunk := make([]byte, 16)
+	le.PutUint16(fmtChunk[0:], uint16(format))
+	le.PutUint16(fmtChunk[2:], uint16(channels))
+	le.PutUint32(fmtChunk[4:], uint32(sampleRate))
+	le.PutUint32(fmtChunk[8:], uint32(sampleRate*blockAlign))
+	le.PutUint16(fmtChunk[12:], uint16(blockAlign))
+	le.PutUint16(fmtChunk[14:], uint16(bits))
+
+	chunk := func(id string, body []byte) []byte {
+		b := append([]byte(id), 0, 0, 0, 0)
+		le.PutUint32(b[4:], uint32(len(body)))
+		b = append(b, body...)
+		if len(body)%2 == 1 {
+			b = append(b, 0)
+		}
+		return b
+	}
+	body := append([]byte("WAVE"), chunk("fmt ", fmtChunk)...)
+	body = append(body, chunk("LIST", []byte("INFOjunk"))...)
+	body = append(body, chunk("data", data)...)
+	out := append([]byte("RIFF"), 0, 0, 0, 0)
+	le.PutUint32(out[4:], uint32(len(body)))
+	return append(out, body...)
+}
+
+// pcm16 encodes samples from -1 to 1 as 16-bit PCM.
+func pcm16(samples []float64) []byte {
+	b := make([]byte, 2*len(samples))
+	for i, s := range samples {
+		binary.LittleEndian.PutUint16(b[2*i:], uint16(int16(s*math.MaxInt16)))
+	}
+	return b
+}
+
+// quietThenLoud returns n samples: silence, then a square wave of amplitude 0.5.
+func quietThenLoud(n int) []float64 {
+	samples := make([]float64, n)
+	for i := n / 2; i < n; i++ {
+		samples[i] = 0.5
+		if i%2 == 1 {
+			samples[i] = -0.5
+		}
+	}
+	return samples
+}
+
+func TestAnalyzeWAV(t *testing.T) {
+	const rate = 8000
+	samples := quietThenLoud(rate) // One second.
+
+	float32s := make([]byte, 4*len(samples))
+	pcm8 := make([]byte, len(samples))
+	pcm24 := make([]byte, 3*len(samples))
+	stereo := make([]byte, 4*len(samples))
+	for i, s := range samples {
+		binary.LittleEndian.PutUint32(float32s[4*i:], math.Float32bits(float32(s)))
+		pcm8[i] = byte(128 + s*127)
+		v := int32(s * (1<<23 - 1))
+		pcm24[3*i], pcm24[3*i+1], pcm24[3*i+2] = byte(v), byte(v>>8), byte(v>>16)
+		copy(stereo[4*i:], pcm16([]float64{s, -s}))
+	}
+	extensible := makeWAV(wavFormatExtensible, 1, rate, 16, pcm16(samples))
+	// Grow the fmt chunk to 40 bytes, with the PCM sub-format GUID at offset 24.
+	fmtExt := make([]byte, 40)
+	copy(fmtExt, extensible[20:36])
+	binary.LittleEndian.PutUint16(fmtExt[16:], 22)
+	binary.LittleEndian.PutUint16(fmtExt[24:], wavFormatPCM)
+	extensible = append(append(append(extensible[:12:12], "fmt \x28\x00\x00\x00"...), fmtExt...), extensible[36:]...)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"16-bit PCM", makeWAV(wavFormatPCM, 1, rate, 16, pcm16(samples))},
+		{"8-bit PCM", makeWAV(wavFormatPCM, 1, rate, 8, pcm8)},
+		{"24-bit PCM", makeWAV(wavFormatPCM, 1, rate, 24, pcm24)},
+		{"32-bit float", makeWAV(wavFormatFloat, 1, rate, 32, float32s)},
+		{"stereo", makeWAV(wavFormatPCM, 2, rate, 16, stereo)},
+		{"extensible", extensible},
+	}
+	for _, tt := range tests {
+		secs, wave, err := AnalyzeWAV(tt.data, 4)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if math.Abs(secs-1) > 1e-9 {
+			t.Errorf("%s: duration %v, want 1", tt.name, secs)
+		}
+		if want := []int{0, 0, WaveformMax, WaveformMax}; !reflect.DeepEqual(wave, want) {
+			t.Errorf("%s: waveform %v, want %v", tt.name, wave, want)
+		}
+	}
+}
+
+func TestAnalyzeWAVTruncated(t *testing.T) {
+	data := makeWAV(wavFormatPCM, 1, 8000, 16, pcm16(quietThenLoud(8000)))
+	// Cut off mid-recording: the data chunk claims more than there is.
+	data = data[:len(data)-8000]
+	secs, wave, err := AnalyzeWAV(data, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(secs-0.5) > 1e-9 || len(wave) != 8 {
+		t.Errorf("got %v seconds, %d samples", secs, len(wave))
+	}
+}
+
+func TestAnalyzeWAVSilenceAndEmpty(t *testing.T) {
+	secs, wave, err := AnalyzeWAV(makeWAV(wavFormatPCM, 1, 8000, 16, make([]byte, 1600)), 4)
+	if err != nil || math.Abs(secs-0.1) > 1e-9 || !reflect.DeepEqual(wave, []int{0, 0, 0, 0}) {
+		t.Errorf("silence: got %v, %v, %v", secs, wave, err)
+	}
+	// Callers reject a zero duration.
+	if secs, _, err := AnalyzeWAV(makeWAV(wavFormatPCM, 1, 8000, 16, nil), 4); err != nil || secs != 0 {
+		t.Errorf("empty: got %v, %v", secs, err)
+	}
+}
+
+func TestAnalyzeWAVErrors(t *testing.T) {
+	valid := makeWAV(wavFormatPCM, 1, 8000, 16, pcm16(quietThenLoud(100)))
+	noData := valid[:len(valid)-8-200]
+	tests := []struct {
+		name string
+		data []byte
+		n    int
+		want error
+	}{
+		{"not RIFF", append([]byte("RIFX"), valid[4:]...), 4, errInvalidWAV},
+		{"no samples asked for", valid, 0, errInvalidWAV},
+		{"no fmt chunk", append([]byte("RIFF\x00\x00\x00\x00WAVE"), valid[len(valid)-208:]...), 4, errInvalidWAV},
+		{"no data chunk", noData, 4, errInvalidWAV},
+		{"zero sample rate", makeWAV(wavFormatPCM, 1, 0, 16, make([]byte, 4)), 4, errInvalidWAV},
+		{"bad block alignment", func() []byte {
+			d := makeWAV(wavFormatPCM, 1, 8000, 16, make([]byte, 4))
+			binary.LittleEndian.PutUint16(d[32:], 3)
+			return d
+		}(), 4, errInvalidWAV},
+		{"IMA ADPCM", makeWAV(0x11, 1, 8000, 4, make([]byte, 256)), 4, ErrUnsupportedWAV},
+		{"A-law", makeWAV(0x06, 1, 8000, 8, make([]byte, 256)), 4, ErrUnsupportedWAV},
+		{"12-bit PCM", makeWAV(wavFormatPCM, 1, 8000, 12, make([]byte, 256)), 4, ErrUnsupportedWAV},
+	}
+	for _, tt := range tests {
+		if _, _, err := AnalyzeWAV(tt.data, tt.n); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestDownsampleWaveform(t *testing.T) {
+	tests := []struct {
+		in   []int
+		n    int
+		want []int
+	}{
+		{[]int{1, 5, 2, 8, 3, 0}, 3, []int{5, 8, 3}},
+		{[]int{1, 5, 2, 8, 3, 0, 7}, 2, []int{5, 8}},
+		{[]int{4, 9, 1}, 3, []int{4, 9, 1}},
+		{[]int{4, 9}, 5, []int{4, 9}},
+	}
+	for _, tt := range tests {
+		if got := DownsampleWaveform(tt.in, tt.n); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("DownsampleWaveform(%v, %d) = %v, want %v", tt.in, tt.n, got, tt.want)
+		}
+	}
+}
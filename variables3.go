@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"log"
 	"net/http"
 	"nwr/utils"
 	"time"
@@ -11,22 +12,33 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
-// Dummy contact definition.
+// A contact in a user's address book. The dummy contacts stand for registered users;
+// others are imported from vCards.
 type Contact struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
+	ID   string `json:"id" bson:"id"`
+	Name string `json:"name" bson:"name"`
+
+	OwnerID      string   `json:"-" bson:"owner_id,omitempty"`
+	UserID       string   `json:"user_id,omitempty" bson:"user_id,omitempty"` // Set when the contact is a registered user.
+	Phones       []string `json:"phones,omitempty" bson:"phones,omitempty"`
+	Emails       []string `json:"emails,omitempty" bson:"emails,omitempty"`
+	Organization string   `json:"organization,omitempty" bson:"organization,omitempty"`
 }
 
 // Dummy contacts list.
 var dummyContacts = []Contact{
-	{ID: "4", Name: "Aespa"},
-	{ID: "5", Name: "BraveGirls"},
-	{ID: "6", Name: "CherryBullet"},
+	{ID: "4", Name: "Aespa", UserID: "4"},
+	{ID: "5", Name: "BraveGirls", UserID: "5"},
+	{ID: "6", Name: "CherryBullet", UserID: "6"},
 }
 
 func getUserContacts(userID string) []Contact {
-	_ = userID
-	return dummyContacts
+	contacts := append([]Contact{}, dummyContacts...)
+	imported, err := importedContacts(userID)
+	if err != nil {
+		log.Println("Failed to fetch imported contacts:", err)
+	}
+	return append(contacts, imported...)
 }
 
 // Simple chat ID generator (for demo purposes).
@@ -46,27 +58,103 @@ type Chat struct {
 	Name      string `json:"name" bson:"name"`
 	Preview   string `json:"preview" bson:"preview"`
 	Deleted   bool   `json:"deleted" bson:"deleted"`
+
+	Members []string `json:"members,omitempty" bson:"members,omitempty"`
+	Admins  []string `json:"admins,omitempty" bson:"admins,omitempty"`
+	Pins    []Pin    `json:"pins,omitempty" bson:"pins,omitempty"`
+
+	DisappearingTimer string `json:"disappearing_timer,omitempty" bson:"disappearing_timer,omitempty"` // One of disappearingTimers.
+
+	// Per-user state; the stored mutes are returned as the requesting user's Muted/MutedUntil.
+	Mutes         []Mute     `json:"-" bson:"mutes,omitempty"`
+	Muted         bool       `json:"muted,omitempty" bson:"-"`
+	MutedUntil    *time.Time `json:"muted_until,omitempty" bson:"-"`
+	MentionUnread int        `json:"mention_unread,omitempty" bson:"-"`
 }
 
 type Message struct {
 	MessageID   string    `json:"message_id" bson:"message_id,omitempty"` // MongoDB can auto-generate an _id if needed.
 	ChatID      string    `json:"chat_id" bson:"chat_id"`
+	Type        string    `json:"type,omitempty" bson:"type,omitempty"` // Empty for plain text messages.
 	Sender      string    `json:"sender" bson:"sender"`
 	Content     string    `json:"content,omitempty" bson:"content,omitempty"`
 	Caption     string    `json:"caption,omitempty" bson:"caption,omitempty"`
+	ReplyTo     *Quote    `json:"reply_to,omitempty" bson:"reply_to,omitempty"`
 	File        string    `json:"filename,omitempty" bson:"filename,omitempty"`
 	EditHistory []string  `json:"edithistory,omitempty" bson:"edithistory,omitempty"`
 	EditedAt    time.Time `json:"editedat" bson:"editedat"`
 	CreatedAt   time.Time `json:"createdat" bson:"createdat"`
 	Deleted     bool      `json:"deleted" bson:"deleted"`
+	AsDocument  bool      `json:"as_document,omitempty" bson:"as_document,omitempty"` // Sent as a file, without image processing.
+
+	ExpiresAt *time.Time `json:"expiresat,omitempty" bson:"expiresat,omitempty"` // Set in chats with disappearing messages.
+	Mentions  []Mention  `json:"mentions,omitempty" bson:"mentions,omitempty"`
+
+	// Content without its markup, when it has any, and the formatting of Text (or else of
+	// Content); see formatText.
+	Text     string       `json:"text,omitempty" bson:"text,omitempty"`
+	Entities []TextEntity `json:"entities,omitempty" bson:"entities,omitempty"`
+
+	Voice       *VoiceNote   `json:"voice,omitempty" bson:"voice,omitempty"`
+	LinkPreview *LinkPreview `json:"link_preview,omitempty" bson:"link_preview,omitempty"` // Filled in after the send.
+
+	// View-once media is served once per recipient through /api/messages/:id/media.
+	ViewOnce bool       `json:"view_once,omitempty" bson:"view_once,omitempty"`
+	OpenedBy []string   `json:"opened_by,omitempty" bson:"opened_by,omitempty"`
+	Opened   bool       `json:"opened,omitempty" bson:"opened,omitempty"` // Every recipient has opened it and the file is gone.
+	OpenedAt *time.Time `json:"openedat,omitempty" bson:"openedat,omitempty"`
+
+	// Stored file the message points at; see Blob.
+	BlobHash     string `json:"blob_hash,omitempty" bson:"blob_hash,omitempty"`
+	OriginalName string `json:"original_name,omitempty" bson:"original_name,omitempty"`
+	Size         int64  `json:"size,omitempty" bson:"size,omitempty"`
+
+	Event        *SystemEvent `json:"event,omitempty" bson:"event,omitempty"`                 // Set on system messages.
+	Poll         *Poll        `json:"poll,omitempty" bson:"poll,omitempty"`                   // Set on polls.
+	Location     *Location    `json:"location,omitempty" bson:"location,omitempty"`           // Set on location messages.
+	Contact      *ContactCard `json:"contact,omitempty" bson:"contact,omitempty"`             // Set on contact cards.
+	ForwardCount int          `json:"forward_count,omitempty" bson:"forward_count,omitempty"` // Times the content has been forwarded.
+
+	// Thread replies carry their root's ID; roots carry a summary of their replies.
+	ThreadID     string         `json:"thread_id,omitempty" bson:"thread_id,omitempty"`
+	Thread       *ThreadSummary `json:"thread,omitempty" bson:"thread,omitempty"`
+	ThreadUnread int            `json:"thread_unread,omitempty" bson:"-"`
+
+	// Raw reactions are stored; clients get them aggregated per emoji.
+	Reactions       []Reaction      `json:"-" bson:"reactions,omitempty"`
+	ReactionSummary []ReactionCount `json:"reactions,omitempty" bson:"-"`
+
+	// Image metadata, filled in asynchronously by the media workers.
+	Width      int         `json:"width,omitempty" bson:"width,omitempty"`
+	Height     int         `json:"height,omitempty" bson:"height,omitempty"`
+	Thumbnail  string      `json:"thumbnail,omitempty" bson:"thumbnail,omitempty"`
+	Renditions []Rendition `json:"renditions,omitempty" bson:"renditions,omitempty"`
+
+	// Placeholder shown by clients while the image loads.
+	BlurHash      string `json:"blurhash,omitempty" bson:"blurhash,omitempty"`
+	DominantColor string `json:"dominant_color,omitempty" bson:"dominant_color,omitempty"`
+}
+
+// A resized copy of an uploaded image.
+type Rendition struct {
+	Name   string `json:"name" bson:"name"`
+	URL    string `json:"url" bson:"url"`
+	Width  int    `json:"width" bson:"width"`
+	Height int    `json:"height" bson:"height"`
 }
 
 // Global variables for MongoDB.
 var (
-	mongoClient        *mongo.Client
-	db                 *mongo.Database
-	chatsCollection    *mongo.Collection
-	messagesCollection *mongo.Collection
+	mongoClient            *mongo.Client
+	db                     *mongo.Database
+	chatsCollection        *mongo.Collection
+	messagesCollection     *mongo.Collection
+	uploadsCollection      *mongo.Collection
+	blobsCollection        *mongo.Collection
+	starsCollection        *mongo.Collection
+	scheduledCollection    *mongo.Collection
+	storageHoldsCollection *mongo.Collection
+	contactsCollection     *mongo.Collection
 )
 
 // Global Redis client.
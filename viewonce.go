@@ -0,0 +1,185 @@
+package main
+
+import (
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"nwr/utils"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// View-once media is kept out of the public uploads directory and out of blob deduplication.
+// Each recipient can fetch it once through viewOnceMediaHandler; once everyone has, the file is
+// removed and the message is left as an "opened" placeholder.
+
+const viewOnceDir = "./private/viewonce"
+
+// Write view-once media under a random name and return the name and size.
+func storeViewOnce(src io.Reader, filename string) (string, int64, error) {
+	if err := ensureDir(viewOnceDir); err != nil {
+		return "", 0, err
+	}
+
+	name := utils.GenerateStringName(32) + strings.ToLower(filepath.Ext(filename))
+	f, err := os.OpenFile(filepath.Join(viewOnceDir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", 0, err
+	}
+	size, err := io.Copy(f, src)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		removeViewOnceFile(name)
+		return "", 0, err
+	}
+	return name, size, nil
+}
+
+func removeViewOnceFile(file string) {
+	if file == "" {
+		return
+	}
+	if err := os.Remove(filepath.Join(viewOnceDir, file)); err != nil && !os.IsNotExist(err) {
+		log.Println("Failed to remove view-once file:", file, err)
+	}
+}
+
+// Release whatever stored file a message points at.
+func releaseMessageMedia(msg Message) {
+	if msg.ViewOnce {
+		removeViewOnceFile(msg.File)
+		return
+	}
+	releaseBlob(msg.BlobHash)
+}
+
+// Users that still have to open a view-once message. Chats without recorded members are
+// treated as one-to-one, so the first open is the last.
+func viewOnceRecipients(msg Message) []string {
+	var chat Chat
+	if err := chatsCollection.FindOne(ctx, bson.M{"chat_id": msg.ChatID}).Decode(&chat); err != nil {
+		return nil
+	}
+	var pending []string
+	for _, m := range chat.Members {
+		if m != msg.Sender && !utils.Contains(msg.OpenedBy, m) {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
+
+// Show a view-once message as opened to the users that have opened it.
+func setViewOnceOpened(msgs []Message, userID string) {
+	for i := range msgs {
+		m := &msgs[i]
+		if !m.ViewOnce || m.Sender == userID {
+			continue
+		}
+		if m.Opened || utils.Contains(m.OpenedBy, userID) {
+			m.Opened = true
+			m.File, m.OriginalName, m.Size = "", "", 0
+		}
+	}
+}
+
+func broadcastOpened(msg Message, userID string) {
+	wsMessage := struct {
+		Type      string `json:"type"`
+		ChatID    string `json:"chat_id"`
+		MessageID string `json:"message_id"`
+		UserID    string `json:"user_id"`
+		Opened    bool   `json:"opened"` // True once every recipient has opened it.
+	}{
+		Type:      "opened",
+		ChatID:    msg.ChatID,
+		MessageID: msg.MessageID,
+		UserID:    userID,
+		Opened:    msg.Opened,
+	}
+	wsBroadcast(msg.ChatID, wsMessage)
+}
+
+// --- Handlers ---
+
+// Serve view-once media to a recipient, once. The sender gets an "opened" receipt.
+func viewOnceMediaHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	msg, err := getMemberMessage(ps.ByName("id"), claims.UserID)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch message", http.StatusInternalServerError)
+		return
+	}
+	if !msg.ViewOnce {
+		http.Error(w, "Not a view-once message", http.StatusBadRequest)
+		return
+	}
+	if msg.Sender == claims.UserID {
+		http.Error(w, "View-once media can't be opened by its sender", http.StatusForbidden)
+		return
+	}
+
+	// Record the open before serving so concurrent requests can't both get the file.
+	filter := bson.M{"message_id": msg.MessageID, "opened": bson.M{"$ne": true}, "opened_by": bson.M{"$ne": claims.UserID}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = messagesCollection.FindOneAndUpdate(ctx, filter, bson.M{"$addToSet": bson.M{"opened_by": claims.UserID}}, opts).Decode(&msg)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Already opened", http.StatusGone)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to open message", http.StatusInternalServerError)
+		return
+	}
+
+	f, err := os.Open(filepath.Join(viewOnceDir, msg.File))
+	if err != nil {
+		http.Error(w, "Media no longer available", http.StatusGone)
+		return
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(msg.File))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(msg.Size, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	if _, err := io.Copy(w, f); err != nil {
+		log.Println("View-once copy error:", msg.MessageID, err)
+	}
+	f.Close()
+
+	if len(viewOnceRecipients(msg)) == 0 {
+		update := bson.M{
+			"$set":   bson.M{"opened": true, "openedat": time.Now()},
+			"$unset": bson.M{"filename": "", "original_name": "", "size": ""},
+		}
+		if _, err := messagesCollection.UpdateOne(ctx, bson.M{"message_id": msg.MessageID}, update); err != nil {
+			log.Println("Failed to mark view-once message opened:", msg.MessageID, err)
+		} else {
+			removeViewOnceFile(msg.File)
+			msg.Opened = true
+		}
+	}
+	broadcastOpened(msg, claims.UserID)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"nwr/utils"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Voice notes are audio messages with their duration and a waveform to draw. Both are
+// worked out from the audio for uncompressed WAV files; for other codecs the client sends
+// them along.
+// Recipients report playing a voice note, which the sender sees as a "played" receipt.
+
+const MessageTypeVoice = "voice"
+
+const (
+	maxVoiceNoteSize     = 16 << 20
+	maxVoiceNoteDuration = 30 * 60 // Seconds.
+	// Waveforms are stored with this many samples, each 0 to utils.WaveformMax.
+	voiceWaveformSamples = 64
+	// Longest waveform accepted from a client, before it is downsampled.
+	maxClientWaveformSamples = 1024
+)
+
+type VoiceNote struct {
+	Duration float64  `json:"duration" bson:"duration"` // Seconds.
+	Waveform []int    `json:"waveform" bson:"waveform"`
+	PlayedBy []string `json:"played_by,omitempty" bson:"played_by,omitempty"`
+}
+
+var (
+	errVoiceNotAudio      = errors.New("voice notes must be audio files")
+	errVoiceDuration      = errors.New("duration must be a number of seconds, at most 30 minutes")
+	errVoiceWaveform      = errors.New("waveform must be a JSON array of 1 to 1024 values from 0 to 100")
+	errVoiceWaveformEmpty = errors.New("duration and waveform are required for audio other than uncompressed WAV")
+)
+
+func isAudioUpload(contentType, filename string) bool {
+	if strings.HasPrefix(contentType, "audio/") {
+		return true
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".wav", ".ogg", ".oga", ".opus", ".mp3", ".m4a", ".aac", ".amr", ".webm", ".flac":
+		return true
+	}
+	return false
+}
+
+// Work out the voice note metadata of an audio file: from the audio itself for PCM and
+// floating-point WAV, or else from the client's duration (seconds) and waveform (JSON
+// array) form values.
+func newVoiceNote(data []byte, contentType, filename, duration, waveform string) (*VoiceNote, error) {
+	if utils.IsWAV(data) {
+		secs, wave, err := utils.AnalyzeWAV(data, voiceWaveformSamples)
+		if err == nil {
+			if secs <= 0 || secs > maxVoiceNoteDuration {
+				return nil, errVoiceDuration
+			}
+			return &VoiceNote{Duration: math.Round(secs*1000) / 1000, Waveform: wave}, nil
+		}
+		if err != utils.ErrUnsupportedWAV {
+			return nil, err
+		}
+		// Compressed WAV is described by the client, like other codecs.
+	}
+
+	if !isAudioUpload(contentType, filename) {
+		return nil, errVoiceNotAudio
+	}
+	if duration == "" || waveform == "" {
+		return nil, errVoiceWaveformEmpty
+	}
+	secs, err := strconv.ParseFloat(duration, 64)
+	if err != nil || math.IsNaN(secs) || secs <= 0 || secs > maxVoiceNoteDuration {
+		return nil, errVoiceDuration
+	}
+	var wave []int
+	if err := json.Unmarshal([]byte(waveform), &wave); err != nil || len(wave) == 0 || len(wave) > maxClientWaveformSamples {
+		return nil, errVoiceWaveform
+	}
+	for _, v := range wave {
+		if v < 0 || v > utils.WaveformMax {
+			return nil, errVoiceWaveform
+		}
+	}
+	return &VoiceNote{Duration: math.Round(secs*1000) / 1000, Waveform: utils.DownsampleWaveform(wave, voiceWaveformSamples)}, nil
+}
+
+// --- Handlers ---
+
+// Record that the user played a voice note they received.
+func playedVoiceHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	msg, err := getMemberMessage(ps.ByName("id"), claims.UserID)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch message", http.StatusInternalServerError)
+		return
+	}
+	if msg.Type != MessageTypeVoice || msg.Voice == nil {
+		http.Error(w, "Not a voice note", http.StatusBadRequest)
+		return
+	}
+	if msg.Sender == claims.UserID {
+		http.Error(w, "Senders don't send played receipts for their own voice notes", http.StatusForbidden)
+		return
+	}
+
+	// Only the first play sends a receipt.
+	filter := bson.M{"message_id": msg.MessageID, "voice.played_by": bson.M{"$ne": claims.UserID}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = messagesCollection.FindOneAndUpdate(ctx, filter, bson.M{"$addToSet": bson.M{"voice.played_by": claims.UserID}}, opts).Decode(&msg)
+	if err == nil {
+		wsMessage := struct {
+			Type      string    `json:"type"`
+			ChatID    string    `json:"chat_id"`
+			MessageID string    `json:"message_id"`
+			UserID    string    `json:"user_id"`
+			PlayedAt  time.Time `json:"playedat"`
+		}{
+			Type:      "played",
+			ChatID:    msg.ChatID,
+			MessageID: msg.MessageID,
+			UserID:    claims.UserID,
+			PlayedAt:  time.Now(),
+		}
+		wsBroadcast(msg.ChatID, wsMessage)
+	} else if err != mongo.ErrNoDocuments {
+		http.Error(w, "Failed to record play", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bson.M{"message_id": msg.MessageID, "played": true})
+}
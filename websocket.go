@@ -1,51 +1,241 @@
 package main
 
 import (
+	"encoding/json"
 	"log"
 	"net/http"
+	"nwr/utils"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/julienschmidt/httprouter"
 )
 
-// WebSocket handler (remains unchanged).
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = (wsPongWait * 9) / 10
+	wsSendBuffer = 64
+)
+
+// A connected socket and the chats it is subscribed to.
+type wsClient struct {
+	conn   *websocket.Conn
+	userID string
+	send   chan []byte
+	chats  map[string]bool // Only touched by the client's read loop.
+}
+
+// Connections subscribed to each chat.
+var (
+	activeConnectionsMu sync.RWMutex
+	activeConnections   = make(map[string]map[*wsClient]bool)
+)
+
+// Connections of each user, for events that don't belong to a chat subscription.
+var (
+	userConnectionsMu sync.RWMutex
+	userConnections   = make(map[string]map[*wsClient]bool)
+)
+
+// Frames sent by clients.
+type wsFrame struct {
+	Type   string          `json:"type"`
+	ChatID string          `json:"chat_id"`
+	Data   json.RawMessage `json:"data,omitempty"`
+}
+
+// WebSocket handler. The token is taken from the Authorization header or, for browsers,
+// the token query parameter. Clients then send {"type": "subscribe", "chat_id": ...}
+// for each chat they want live events from.
 func wsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	tokenString := r.Header.Get("Authorization")
+	if token := r.URL.Query().Get("token"); tokenString == "" && token != "" {
+		tokenString = "Bearer " + token
+	}
+	claims, err := utils.ValidateJWT(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println("WebSocket Upgrade:", err)
 		return
 	}
-	defer conn.Close()
+
+	client := &wsClient{
+		conn:   conn,
+		userID: claims.UserID,
+		send:   make(chan []byte, wsSendBuffer),
+		chats:  make(map[string]bool),
+	}
+	rememberHandle(claims.Username, claims.UserID)
+	wsRegisterUser(client)
+	go client.writeLoop()
+	client.readLoop()
+}
+
+func (c *wsClient) readLoop() {
+	defer func() {
+		for chatID := range c.chats {
+			wsUnsubscribe(c, chatID)
+		}
+		wsUnregisterUser(c)
+		close(c.send)
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
 
 	for {
-		_, msg, err := conn.ReadMessage()
+		_, msg, err := c.conn.ReadMessage()
 		if err != nil {
-			log.Println("WebSocket read error:", err)
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Println("WebSocket read error:", err)
+			}
 			break
 		}
-		log.Printf("Received: %s", msg)
 
-		// In production, send real-time updates.
-		if err = conn.WriteMessage(websocket.TextMessage, msg); err != nil {
-			log.Println("WebSocket write error:", err)
-			break
+		var frame wsFrame
+		if err := json.Unmarshal(msg, &frame); err != nil {
+			c.sendJSON(map[string]string{"type": "error", "error": "invalid frame"})
+			continue
+		}
+
+		switch frame.Type {
+		case "subscribe":
+			if _, err := getMemberChat(frame.ChatID, c.userID); err != nil {
+				c.sendJSON(map[string]string{"type": "error", "chat_id": frame.ChatID, "error": "chat not found"})
+				continue
+			}
+			c.chats[frame.ChatID] = true
+			wsSubscribe(c, frame.ChatID)
+		case "unsubscribe":
+			delete(c.chats, frame.ChatID)
+			wsUnsubscribe(c, frame.ChatID)
+		case "location", "location_stop":
+			if err := handleLocationFrame(c, frame); err != nil {
+				c.sendJSON(map[string]string{"type": "error", "chat_id": frame.ChatID, "error": err.Error()})
+			}
+		case "ping":
+			c.sendJSON(map[string]string{"type": "pong"})
+		default:
+			c.sendJSON(map[string]string{"type": "error", "error": "unknown frame type: " + frame.Type})
 		}
 	}
 }
 
+func (c *wsClient) writeLoop() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				log.Println("WebSocket write error:", err)
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *wsClient) sendJSON(message interface{}) {
+	msgData, err := json.Marshal(message)
+	if err != nil {
+		log.Println("WebSocket marshal error:", err)
+		return
+	}
+	c.queue(msgData)
+}
+
+// Queue a frame for the client, dropping it if the client can't keep up.
+func (c *wsClient) queue(msgData []byte) {
+	select {
+	case c.send <- msgData:
+	default:
+		log.Println("WebSocket send buffer full, dropping message for", c.userID)
+	}
+}
+
+func wsSubscribe(c *wsClient, chatID string) {
+	activeConnectionsMu.Lock()
+	defer activeConnectionsMu.Unlock()
+	if activeConnections[chatID] == nil {
+		activeConnections[chatID] = make(map[*wsClient]bool)
+	}
+	activeConnections[chatID][c] = true
+}
+
+func wsUnsubscribe(c *wsClient, chatID string) {
+	activeConnectionsMu.Lock()
+	defer activeConnectionsMu.Unlock()
+	delete(activeConnections[chatID], c)
+	if len(activeConnections[chatID]) == 0 {
+		delete(activeConnections, chatID)
+	}
+}
+
+func wsRegisterUser(c *wsClient) {
+	userConnectionsMu.Lock()
+	defer userConnectionsMu.Unlock()
+	if userConnections[c.userID] == nil {
+		userConnections[c.userID] = make(map[*wsClient]bool)
+	}
+	userConnections[c.userID][c] = true
+}
+
+func wsUnregisterUser(c *wsClient) {
+	userConnectionsMu.Lock()
+	defer userConnectionsMu.Unlock()
+	delete(userConnections[c.userID], c)
+	if len(userConnections[c.userID]) == 0 {
+		delete(userConnections, c.userID)
+	}
+}
+
+// Send a message to every connection of a user, whatever they are subscribed to.
+func wsNotifyUser(userID string, message interface{}) {
+	msgData, err := json.Marshal(message)
+	if err != nil {
+		log.Println("WebSocket marshal error:", err)
+		return
+	}
+
+	userConnectionsMu.RLock()
+	defer userConnectionsMu.RUnlock()
+	for conn := range userConnections[userID] {
+		conn.queue(msgData)
+	}
+}
+
+// Send a message to every connection subscribed to the chat.
 func wsBroadcast(chatID string, message interface{}) {
-	// msgData, _ := json.Marshal(message)
-	// log.Println(chatID, message, msgData)
-	// for _, conn := range activeConnections[chatID] {
-	// 	conn.WriteMessage(websocket.TextMessage, msgData)
-	// }
-}
-
-// func wsBroadcast(chatID int, message interface{}) {
-// 	msgData, _ := json.Marshal(message)
-// 	// Loop through all active connections for this chat and write the message.
-// 	// activeConnections is assumed to be a map[int][]*websocket.Conn or similar.
-// 	for _, conn := range activeConnections[chatID] {
-// 		conn.WriteMessage(websocket.TextMessage, msgData)
-// 	}
-// }
+	msgData, err := json.Marshal(message)
+	if err != nil {
+		log.Println("WebSocket marshal error:", err)
+		return
+	}
+
+	activeConnectionsMu.RLock()
+	defer activeConnectionsMu.RUnlock()
+	for conn := range activeConnections[chatID] {
+		conn.queue(msgData)
+	}
+}